@@ -1,3 +1,5 @@
+//go:build eventticket
+
 /*
  * Copyright 2023 Google Inc.
  *
@@ -62,7 +64,19 @@ func (d *demoEventticket) auth() {
 
 // [START createClass]
 // Create a class.
-func (d *demoEventticket) createClass(issuerId, classSuffix string) {
+//
+// viewUnlockRequirement can be set to UNLOCK_REQUIRED_TO_VIEW to make users
+// unlock their device each time they open the ticket, so someone else
+// holding the phone can't show the barcode. Users without a screen lock are
+// asked to set one up first. Empty leaves the API's default, which doesn't
+// require unlocking.
+func (d *demoEventticket) createClass(issuerId, classSuffix, viewUnlockRequirement string) {
+	switch viewUnlockRequirement {
+	case "", "VIEW_UNLOCK_REQUIREMENT_UNSPECIFIED", "UNLOCK_NOT_REQUIRED", "UNLOCK_REQUIRED_TO_VIEW":
+	default:
+		log.Fatalf("Unknown view unlock requirement %q", viewUnlockRequirement)
+	}
+
 	eventticketClass := new(walletobjects.EventTicketClass)
 	eventticketClass.Id = fmt.Sprintf("%s.%s", issuerId, classSuffix)
 	eventticketClass.EventName = &walletobjects.LocalizedString{
@@ -73,6 +87,7 @@ func (d *demoEventticket) createClass(issuerId, classSuffix string) {
 	}
 	eventticketClass.IssuerName = "Issuer name"
 	eventticketClass.ReviewStatus = "UNDER_REVIEW"
+	eventticketClass.ViewUnlockRequirement = viewUnlockRequirement
 	res, err := d.service.Eventticketclass.Insert(eventticketClass).Do()
 	if err != nil {
 		log.Fatalf("Unable to insert class: %v", err)
@@ -194,6 +209,31 @@ func (d *demoEventticket) expireObject(issuerId, objectSuffix string) {
 
 // [END expireObject]
 
+// [START transferTicket]
+// Transfer a ticket to a new holder.
+//
+// Only the holder name and ticket number are patched, so the rest of the
+// ticket is unchanged and the pass stays saved in the wallet it was added
+// to. Ticket numbers aren't checked for uniqueness, here or by the API;
+// keeping them unique across an event is up to the issuer.
+func (d *demoEventticket) updateTicketHolder(issuerId, objectSuffix, ticketHolderName, ticketNumber string) {
+	if ticketHolderName == "" || ticketNumber == "" {
+		log.Fatalf("Ticket holder name and ticket number are required")
+	}
+	eventticketObject := &walletobjects.EventTicketObject{
+		TicketHolderName: ticketHolderName,
+		TicketNumber:     ticketNumber,
+	}
+	res, err := d.service.Eventticketobject.Patch(fmt.Sprintf("%s.%s", issuerId, objectSuffix), eventticketObject).Do()
+	if err != nil {
+		log.Fatalf("Unable to patch object: %v", err)
+	} else {
+		fmt.Printf("Object ticket holder update id:\n%s\n", res.Id)
+	}
+}
+
+// [END transferTicket]
+
 // [START jwtNew]
 // Generate a signed JWT that creates a new pass class and object.
 //
@@ -246,38 +286,38 @@ func (d *demoEventticket) createJwtExistingObjects(issuerId string, classSuffix
 	json.Unmarshal([]byte(fmt.Sprintf(`
 	{
 		"eventTicketObjects": [{
-			"id": "%s.EVENT_OBJECT_SUFFIX",
-			"classId": "%s.EVENT_CLASS_SUFFIX"
+			"id": "%[1]s.EVENT_OBJECT_SUFFIX",
+			"classId": "%[1]s.EVENT_CLASS_SUFFIX"
 		}],
 
 		"flightObjects": [{
-			"id": "%s.FLIGHT_OBJECT_SUFFIX",
-			"classId": "%s.FLIGHT_CLASS_SUFFIX"
+			"id": "%[1]s.FLIGHT_OBJECT_SUFFIX",
+			"classId": "%[1]s.FLIGHT_CLASS_SUFFIX"
 		}],
 
 		"genericObjects": [{
-			"id": "%s.GENERIC_OBJECT_SUFFIX",
-			"classId": "%s.GENERIC_CLASS_SUFFIX"
+			"id": "%[1]s.GENERIC_OBJECT_SUFFIX",
+			"classId": "%[1]s.GENERIC_CLASS_SUFFIX"
 		}],
 
 		"giftCardObjects": [{
-			"id": "%s.GIFT_CARD_OBJECT_SUFFIX",
-			"classId": "%s.GIFT_CARD_CLASS_SUFFIX"
+			"id": "%[1]s.GIFT_CARD_OBJECT_SUFFIX",
+			"classId": "%[1]s.GIFT_CARD_CLASS_SUFFIX"
 		}],
 
 		"eventticketObjects": [{
-			"id": "%s.LOYALTY_OBJECT_SUFFIX",
-			"classId": "%s.LOYALTY_CLASS_SUFFIX"
+			"id": "%[1]s.LOYALTY_OBJECT_SUFFIX",
+			"classId": "%[1]s.LOYALTY_CLASS_SUFFIX"
 		}],
 
 		"offerObjects": [{
-			"id": "%s.OFFER_OBJECT_SUFFIX",
-			"classId": "%s.OFFER_CLASS_SUFFIX"
+			"id": "%[1]s.OFFER_OBJECT_SUFFIX",
+			"classId": "%[1]s.OFFER_CLASS_SUFFIX"
 		}],
 
 		"transitObjects": [{
-			"id": "%s.TRANSIT_OBJECT_SUFFIX",
-			"classId": "%s.TRANSIT_CLASS_SUFFIX"
+			"id": "%[1]s.TRANSIT_OBJECT_SUFFIX",
+			"classId": "%[1]s.TRANSIT_CLASS_SUFFIX"
 		}]
 	}
 	`, issuerId)), &payload)
@@ -344,8 +384,9 @@ func main() {
 	d := demoEventticket{}
 
 	d.auth()
-	d.createClass(issuerId, classSuffix)
+	d.createClass(issuerId, classSuffix, "")
 	d.createObject(issuerId, classSuffix, objectSuffix)
+	d.updateTicketHolder(issuerId, objectSuffix, "New ticket holder name", "New ticket number")
 	d.expireObject(issuerId, objectSuffix)
 	d.createJwtNewObjects(issuerId, classSuffix, objectSuffix)
 	d.createJwtExistingObjects(issuerId, classSuffix, objectSuffix)
@@ -1,3 +1,5 @@
+//go:build flight
+
 /*
  * Copyright 2023 Google Inc.
  *
@@ -22,6 +24,7 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/golang-jwt/jwt"
 	"github.com/google/uuid"
@@ -186,6 +189,62 @@ func (d *demoFlight) expireObject(issuerId, objectSuffix string) {
 
 // [END expireObject]
 
+// [START updateSeat]
+// Change the seat and boarding group of a boarding pass, e.g. after a seat
+// reassignment.
+//
+// Patching boardingAndSeatingInfo replaces it entirely, so the current
+// object is read first and only the seat and boarding group changed; the
+// boarding door, seat class and other fields are kept. The boarding group
+// is shown as a zone or group according to the class's boarding policy,
+// and is required unless the policy is BOARDING_POLICY_OTHER.
+func (d *demoFlight) updateSeat(issuerId, objectSuffix, seat, boardingGroup string) {
+	id := fmt.Sprintf("%s.%s", issuerId, objectSuffix)
+	flightObject, err := d.service.Flightobject.Get(id).Do()
+	if err != nil {
+		log.Fatalf("Unable to get object: %v", err)
+	}
+
+	// Objects returned by Get include a copy of their class
+	if err := validateSeat(flightObject.ClassReference, seat, boardingGroup); err != nil {
+		log.Fatalf("Invalid seat: %v", err)
+	}
+
+	info := flightObject.BoardingAndSeatingInfo
+	if info == nil {
+		info = new(walletobjects.BoardingAndSeatingInfo)
+	}
+	info.SeatNumber = seat
+	info.BoardingGroup = boardingGroup
+	res, err := d.service.Flightobject.Patch(id, &walletobjects.FlightObject{
+		BoardingAndSeatingInfo: info,
+	}).Do()
+	if err != nil {
+		log.Fatalf("Unable to patch object: %v", err)
+	} else {
+		fmt.Printf("Object seat update id:\n%s\n", res.Id)
+	}
+}
+
+// Check a seat and boarding group against the boarding policy of a class,
+// ZONE_BASED if the class doesn't set one. The boarding group can only be
+// left empty under BOARDING_POLICY_OTHER.
+func validateSeat(flightClass *walletobjects.FlightClass, seat, boardingGroup string) error {
+	if seat == "" {
+		return errors.New("seat number is empty")
+	}
+	policy := "ZONE_BASED"
+	if flightClass != nil && flightClass.BoardingAndSeatingPolicy != nil && flightClass.BoardingAndSeatingPolicy.BoardingPolicy != "" {
+		policy = flightClass.BoardingAndSeatingPolicy.BoardingPolicy
+	}
+	if boardingGroup == "" && policy != "BOARDING_POLICY_OTHER" {
+		return fmt.Errorf("boarding group is required by the class's %s boarding policy", policy)
+	}
+	return nil
+}
+
+// [END updateSeat]
+
 // [START jwtNew]
 // Generate a signed JWT that creates a new pass class and object.
 //
@@ -240,38 +299,38 @@ func (d *demoFlight) createJwtExistingObjects(issuerId string, classSuffix strin
 	json.Unmarshal([]byte(fmt.Sprintf(`
 	{
 		"eventTicketObjects": [{
-			"id": "%s.EVENT_OBJECT_SUFFIX",
-			"classId": "%s.EVENT_CLASS_SUFFIX"
+			"id": "%[1]s.EVENT_OBJECT_SUFFIX",
+			"classId": "%[1]s.EVENT_CLASS_SUFFIX"
 		}],
 
 		"flightObjects": [{
-			"id": "%s.FLIGHT_OBJECT_SUFFIX",
-			"classId": "%s.FLIGHT_CLASS_SUFFIX"
+			"id": "%[1]s.FLIGHT_OBJECT_SUFFIX",
+			"classId": "%[1]s.FLIGHT_CLASS_SUFFIX"
 		}],
 
 		"genericObjects": [{
-			"id": "%s.GENERIC_OBJECT_SUFFIX",
-			"classId": "%s.GENERIC_CLASS_SUFFIX"
+			"id": "%[1]s.GENERIC_OBJECT_SUFFIX",
+			"classId": "%[1]s.GENERIC_CLASS_SUFFIX"
 		}],
 
 		"giftCardObjects": [{
-			"id": "%s.GIFT_CARD_OBJECT_SUFFIX",
-			"classId": "%s.GIFT_CARD_CLASS_SUFFIX"
+			"id": "%[1]s.GIFT_CARD_OBJECT_SUFFIX",
+			"classId": "%[1]s.GIFT_CARD_CLASS_SUFFIX"
 		}],
 
 		"loyaltyObjects": [{
-			"id": "%s.LOYALTY_OBJECT_SUFFIX",
-			"classId": "%s.LOYALTY_CLASS_SUFFIX"
+			"id": "%[1]s.LOYALTY_OBJECT_SUFFIX",
+			"classId": "%[1]s.LOYALTY_CLASS_SUFFIX"
 		}],
 
 		"flightObjects": [{
-			"id": "%s.OFFER_OBJECT_SUFFIX",
-			"classId": "%s.OFFER_CLASS_SUFFIX"
+			"id": "%[1]s.OFFER_OBJECT_SUFFIX",
+			"classId": "%[1]s.OFFER_CLASS_SUFFIX"
 		}],
 
 		"transitObjects": [{
-			"id": "%s.TRANSIT_OBJECT_SUFFIX",
-			"classId": "%s.TRANSIT_CLASS_SUFFIX"
+			"id": "%[1]s.TRANSIT_OBJECT_SUFFIX",
+			"classId": "%[1]s.TRANSIT_CLASS_SUFFIX"
 		}]
 	}
 	`, issuerId)), &payload)
@@ -342,6 +401,7 @@ func main() {
 	d.auth()
 	d.createClass(issuerId, classSuffix)
 	d.createObject(issuerId, classSuffix, objectSuffix)
+	d.updateSeat(issuerId, objectSuffix, "42C", "A")
 	d.expireObject(issuerId, objectSuffix)
 	d.createJwtNewObjects(issuerId, classSuffix, objectSuffix)
 	d.createJwtExistingObjects(issuerId, classSuffix, objectSuffix)
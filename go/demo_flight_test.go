@@ -0,0 +1,56 @@
+//go:build flight
+
+/*
+ * Copyright 2023 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"google.golang.org/api/walletobjects/v1"
+	"testing"
+)
+
+func TestValidateSeat(t *testing.T) {
+	classWithPolicy := func(policy string) *walletobjects.FlightClass {
+		return &walletobjects.FlightClass{
+			BoardingAndSeatingPolicy: &walletobjects.BoardingAndSeatingPolicy{BoardingPolicy: policy},
+		}
+	}
+	tests := []struct {
+		name          string
+		flightClass   *walletobjects.FlightClass
+		seat          string
+		boardingGroup string
+		wantErr       bool
+	}{
+		{"zone based", classWithPolicy("ZONE_BASED"), "42C", "A", false},
+		{"group based", classWithPolicy("GROUP_BASED"), "42C", "3", false},
+		{"zone based without group", classWithPolicy("ZONE_BASED"), "42C", "", true},
+		{"group based without group", classWithPolicy("GROUP_BASED"), "42C", "", true},
+		{"other without group", classWithPolicy("BOARDING_POLICY_OTHER"), "42C", "", false},
+		{"no class without group", nil, "42C", "", true},
+		{"no policy without group", &walletobjects.FlightClass{}, "42C", "", true},
+		{"no seat", classWithPolicy("BOARDING_POLICY_OTHER"), "", "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := validateSeat(test.flightClass, test.seat, test.boardingGroup)
+			if (err != nil) != test.wantErr {
+				t.Errorf("validateSeat(%q, %q) = %v, want error: %v", test.seat, test.boardingGroup, err, test.wantErr)
+			}
+		})
+	}
+}
@@ -1,3 +1,5 @@
+//go:build generic
+
 /*
  * Copyright 2023 Google Inc.
  *
@@ -33,6 +35,7 @@ import (
 	"io"
 	"log"
 	"os"
+	"strconv"
 	"strings"
 )
 
@@ -145,6 +148,306 @@ func (d *demoGeneric) createObject(issuerId, classSuffix, objectSuffix string) {
 
 // [END createObject]
 
+// [START customPass]
+// Generic types that can be set on a generic object.
+var genericTypes = []string{
+	"GENERIC_TYPE_UNSPECIFIED",
+	"GENERIC_SEASON_PASS",
+	"GENERIC_UTILITY_BILLS",
+	"GENERIC_PARKING_PASS",
+	"GENERIC_VOUCHER",
+	"GENERIC_GYM_MEMBERSHIP",
+	"GENERIC_LIBRARY_MEMBERSHIP",
+	"GENERIC_RESERVATIONS",
+	"GENERIC_AUTO_INSURANCE",
+	"GENERIC_HOME_INSURANCE",
+	"GENERIC_ENTRY_TICKET",
+	"GENERIC_RECEIPT",
+	"GENERIC_OTHER",
+}
+
+// Check that genericType is one of the supported values. An empty value
+// is allowed, and is treated as GENERIC_TYPE_UNSPECIFIED.
+func validateGenericType(genericType string) error {
+	if genericType == "" {
+		return nil
+	}
+	for _, t := range genericTypes {
+		if genericType == t {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown generic type %q", genericType)
+}
+
+// Check that the notifications of a generic object can be sent.
+//
+// Generic passes only notify when asked to, unlike the predefined pass
+// types. The upcoming notification is sent shortly before the pass becomes
+// valid, and the expiry notification shortly before it expires, so each
+// needs the matching end of validTimeInterval.
+func validateGenericNotifications(genericObject *walletobjects.GenericObject) error {
+	notifications := genericObject.Notifications
+	if notifications == nil {
+		return nil
+	}
+	interval := genericObject.ValidTimeInterval
+	if upcoming := notifications.UpcomingNotification; upcoming != nil && upcoming.EnableNotification {
+		if interval == nil || interval.Start == nil {
+			return fmt.Errorf("upcoming notification is enabled but validTimeInterval has no start")
+		}
+	}
+	if expiry := notifications.ExpiryNotification; expiry != nil && expiry.EnableNotification {
+		if interval == nil || interval.End == nil {
+			return fmt.Errorf("expiry notification is enabled but validTimeInterval has no end")
+		}
+	}
+	return nil
+}
+
+// Build a template item showing the text module with the given ID.
+func textModuleItem(id string) *walletobjects.TemplateItem {
+	return &walletobjects.TemplateItem{
+		FirstValue: &walletobjects.FieldSelector{
+			Fields: []*walletobjects.FieldReference{
+				&walletobjects.FieldReference{
+					FieldPath: fmt.Sprintf("object.textModulesData['%s']", id),
+				},
+			},
+		},
+	}
+}
+
+// Create a class with a custom card layout.
+//
+// Generic passes have no predefined template, so the fields shown on the
+// front of the card are chosen by the class. This layout has two rows: the
+// first shows two text modules side by side, the second shows three.
+func (d *demoGeneric) createCustomClass(issuerId, classSuffix string) {
+	genericClass := new(walletobjects.GenericClass)
+	genericClass.Id = fmt.Sprintf("%s.%s", issuerId, classSuffix)
+	genericClass.ClassTemplateInfo = &walletobjects.ClassTemplateInfo{
+		CardTemplateOverride: &walletobjects.CardTemplateOverride{
+			CardRowTemplateInfos: []*walletobjects.CardRowTemplateInfo{
+				&walletobjects.CardRowTemplateInfo{
+					TwoItems: &walletobjects.CardRowTwoItems{
+						StartItem: textModuleItem("MEMBER"),
+						EndItem:   textModuleItem("LEVEL"),
+					},
+				},
+				&walletobjects.CardRowTemplateInfo{
+					ThreeItems: &walletobjects.CardRowThreeItems{
+						StartItem:  textModuleItem("GATE"),
+						MiddleItem: textModuleItem("ROW"),
+						EndItem:    textModuleItem("SEAT"),
+					},
+				},
+			},
+		},
+	}
+	res, err := d.service.Genericclass.Insert(genericClass).Do()
+	if err != nil {
+		log.Fatalf("Unable to insert class: %v", err)
+	} else {
+		fmt.Printf("Class insert id:\n%v\n", res.Id)
+	}
+}
+
+// Values of multipleDevicesAndHoldersAllowedStatus.
+//
+// The status is about the object, not the class: whether the same object
+// can be saved by more than one user, and by one user on more than one
+// device.
+var multipleDevicesAndHoldersAllowedStatuses = []string{
+	// Anyone the object is shared with can save it, on any device, e.g. a
+	// voucher handed out to a group
+	"MULTIPLE_HOLDERS",
+	// The first user to save the object owns it, and can use it on all of
+	// their devices; nobody else can save it, even with the link
+	"ONE_USER_ALL_DEVICES",
+	// As above, but pinned to the first device it's saved on; only for
+	// partners approved by Google, e.g. for device-bound transit tickets
+	"ONE_USER_ONE_DEVICE",
+}
+
+// Check that status is a supported multipleDevicesAndHoldersAllowedStatus.
+// An empty value is allowed, and leaves the status unspecified.
+func validateMultipleDevicesStatus(status string) error {
+	if status == "" {
+		return nil
+	}
+	for _, s := range multipleDevicesAndHoldersAllowedStatuses {
+		if status == s {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown multipleDevicesAndHoldersAllowedStatus %q, must be one of %s", status, strings.Join(multipleDevicesAndHoldersAllowedStatuses, ", "))
+}
+
+// Create a class for membership cards that can be read by NFC terminals,
+// with the given multipleDevicesAndHoldersAllowedStatus.
+//
+// For a membership card, ONE_USER_ALL_DEVICES is usually what you want:
+// the card belongs to the first user who saves it, who can still use it
+// on their phone and watch, and a forwarded save link doesn't give anyone
+// else a copy. MULTIPLE_HOLDERS would let the whole household share one
+// card.
+//
+// The terminals of the issuers in redemptionIssuers can read the card, as
+// long as each object sets the smartTapRedemptionValue they read.
+func (d *demoGeneric) createMembershipClass(issuerId, classSuffix, multipleDevicesAndHoldersAllowedStatus string, redemptionIssuers []int64) {
+	if err := validateMultipleDevicesStatus(multipleDevicesAndHoldersAllowedStatus); err != nil {
+		log.Fatalf("Invalid class: %v", err)
+	}
+	// Smart tap is enabled, so some issuer must be able to read the card
+	if len(redemptionIssuers) == 0 {
+		log.Fatalf("Invalid class: smart tap is enabled but no redemption issuers are set")
+	}
+
+	genericClass := new(walletobjects.GenericClass)
+	genericClass.Id = fmt.Sprintf("%s.%s", issuerId, classSuffix)
+	genericClass.MultipleDevicesAndHoldersAllowedStatus = multipleDevicesAndHoldersAllowedStatus
+	genericClass.EnableSmartTap = true
+	genericClass.RedemptionIssuers = redemptionIssuers
+
+	res, err := d.service.Genericclass.Insert(genericClass).Do()
+	if err != nil {
+		log.Fatalf("Unable to insert class: %v", err)
+	} else {
+		fmt.Printf("Class insert id:\n%v\n", res.Id)
+	}
+}
+
+// Create a membership card for a class created by createMembershipClass.
+//
+// smartTapRedemptionValue is what the terminals of the class's redemption
+// issuers read from the card over NFC, usually the member ID. Without it
+// the card can't be read, even though the class enables smart tap.
+func (d *demoGeneric) createMembershipObject(issuerId, classSuffix, objectSuffix, smartTapRedemptionValue string) {
+	if smartTapRedemptionValue == "" {
+		log.Fatalf("Invalid object: smartTapRedemptionValue is required for smart tap")
+	}
+	genericObject := new(walletobjects.GenericObject)
+	genericObject.Id = fmt.Sprintf("%s.%s", issuerId, objectSuffix)
+	genericObject.ClassId = fmt.Sprintf("%s.%s", issuerId, classSuffix)
+	genericObject.State = "ACTIVE"
+	genericObject.GenericType = "GENERIC_GYM_MEMBERSHIP"
+	genericObject.CardTitle = &walletobjects.LocalizedString{
+		DefaultValue: &walletobjects.TranslatedString{
+			Language: "en-us",
+			Value:    "Card title",
+		},
+	}
+	genericObject.Header = &walletobjects.LocalizedString{
+		DefaultValue: &walletobjects.TranslatedString{
+			Language: "en-us",
+			Value:    "Member name",
+		},
+	}
+	genericObject.SmartTapRedemptionValue = smartTapRedemptionValue
+
+	res, err := d.service.Genericobject.Insert(genericObject).Do()
+	if err != nil {
+		log.Fatalf("Unable to insert object: %v", err)
+	} else {
+		fmt.Printf("Object insert id:\n%s\n", res.Id)
+	}
+}
+
+// Create an object for a class created by createCustomClass.
+//
+// The card title, header and subheader are always shown at the top of the
+// card, followed by the rows defined by the class. The rotating barcode
+// shows a new TOTP code every 30 seconds, so a screenshot of the pass
+// can't be reused. The user is notified before the pass becomes valid and
+// before it expires.
+func (d *demoGeneric) createCustomObject(issuerId, classSuffix, objectSuffix, genericType string) {
+	if err := validateGenericType(genericType); err != nil {
+		log.Fatalf("Invalid object: %v", err)
+	}
+	genericObject := new(walletobjects.GenericObject)
+	genericObject.Id = fmt.Sprintf("%s.%s", issuerId, objectSuffix)
+	genericObject.ClassId = fmt.Sprintf("%s.%s", issuerId, classSuffix)
+	genericObject.State = "ACTIVE"
+	genericObject.GenericType = genericType
+	genericObject.CardTitle = &walletobjects.LocalizedString{
+		DefaultValue: &walletobjects.TranslatedString{
+			Language: "en-us",
+			Value:    "Card title",
+		},
+	}
+	genericObject.Header = &walletobjects.LocalizedString{
+		DefaultValue: &walletobjects.TranslatedString{
+			Language: "en-us",
+			Value:    "Header",
+		},
+	}
+	genericObject.Subheader = &walletobjects.LocalizedString{
+		DefaultValue: &walletobjects.TranslatedString{
+			Language: "en-us",
+			Value:    "Subheader",
+		},
+	}
+	genericObject.RotatingBarcode = &walletobjects.RotatingBarcode{
+		Type:          "QR_CODE",
+		ValuePattern:  "MEMBER-1234-{totp_value_0}",
+		AlternateText: "MEMBER-1234",
+		TotpDetails: &walletobjects.RotatingBarcodeTotpDetails{
+			Algorithm:    "TOTP_SHA1",
+			PeriodMillis: 30000,
+			Parameters: []*walletobjects.RotatingBarcodeTotpDetailsTotpParameters{
+				&walletobjects.RotatingBarcodeTotpDetailsTotpParameters{
+					// Hex encoded shared secret, known to the scanner
+					Key:         "3132333435363738393031323334353637383930",
+					ValueLength: 8,
+				},
+			},
+		},
+	}
+	genericObject.ValidTimeInterval = &walletobjects.TimeInterval{
+		Start: &walletobjects.DateTime{
+			Date: "2023-06-12T18:00:00Z",
+		},
+		End: &walletobjects.DateTime{
+			Date: "2023-06-12T23:00:00Z",
+		},
+	}
+	// Remind the user before the event starts, and before the pass expires
+	genericObject.Notifications = &walletobjects.Notifications{
+		UpcomingNotification: &walletobjects.UpcomingNotification{
+			EnableNotification: true,
+		},
+		ExpiryNotification: &walletobjects.ExpiryNotification{
+			EnableNotification: true,
+		},
+	}
+	// Passes with the same grouping ID are stacked together in the wallet,
+	// in order of sort index
+	genericObject.GroupingInfo = &walletobjects.GroupingInfo{
+		GroupingId: "EVENT_TICKETS",
+		SortIndex:  1,
+	}
+	if err := validateGenericNotifications(genericObject); err != nil {
+		log.Fatalf("Invalid object: %v", err)
+	}
+	genericObject.TextModulesData = []*walletobjects.TextModuleData{
+		&walletobjects.TextModuleData{Id: "MEMBER", Header: "Member", Body: "Jane Doe"},
+		&walletobjects.TextModuleData{Id: "LEVEL", Header: "Level", Body: "Gold"},
+		&walletobjects.TextModuleData{Id: "GATE", Header: "Gate", Body: "B"},
+		&walletobjects.TextModuleData{Id: "ROW", Header: "Row", Body: "12"},
+		&walletobjects.TextModuleData{Id: "SEAT", Header: "Seat", Body: "7"},
+	}
+
+	res, err := d.service.Genericobject.Insert(genericObject).Do()
+	if err != nil {
+		log.Fatalf("Unable to insert object: %v", err)
+	} else {
+		fmt.Printf("Object insert id:\n%s\n", res.Id)
+	}
+}
+
+// [END customPass]
+
 // [START expireObject]
 // Expire an object.
 //
@@ -230,38 +533,38 @@ func (d *demoGeneric) createJwtExistingObjects(issuerId string, classSuffix stri
 	json.Unmarshal([]byte(fmt.Sprintf(`
 	{
 		"eventTicketObjects": [{
-			"id": "%s.EVENT_OBJECT_SUFFIX",
-			"classId": "%s.EVENT_CLASS_SUFFIX"
+			"id": "%[1]s.EVENT_OBJECT_SUFFIX",
+			"classId": "%[1]s.EVENT_CLASS_SUFFIX"
 		}],
 
 		"flightObjects": [{
-			"id": "%s.FLIGHT_OBJECT_SUFFIX",
-			"classId": "%s.FLIGHT_CLASS_SUFFIX"
+			"id": "%[1]s.FLIGHT_OBJECT_SUFFIX",
+			"classId": "%[1]s.FLIGHT_CLASS_SUFFIX"
 		}],
 
 		"genericObjects": [{
-			"id": "%s.GENERIC_OBJECT_SUFFIX",
-			"classId": "%s.GENERIC_CLASS_SUFFIX"
+			"id": "%[1]s.GENERIC_OBJECT_SUFFIX",
+			"classId": "%[1]s.GENERIC_CLASS_SUFFIX"
 		}],
 
 		"giftCardObjects": [{
-			"id": "%s.GIFT_CARD_OBJECT_SUFFIX",
-			"classId": "%s.GIFT_CARD_CLASS_SUFFIX"
+			"id": "%[1]s.GIFT_CARD_OBJECT_SUFFIX",
+			"classId": "%[1]s.GIFT_CARD_CLASS_SUFFIX"
 		}],
 
 		"loyaltyObjects": [{
-			"id": "%s.LOYALTY_OBJECT_SUFFIX",
-			"classId": "%s.LOYALTY_CLASS_SUFFIX"
+			"id": "%[1]s.LOYALTY_OBJECT_SUFFIX",
+			"classId": "%[1]s.LOYALTY_CLASS_SUFFIX"
 		}],
 
 		"offerObjects": [{
-			"id": "%s.OFFER_OBJECT_SUFFIX",
-			"classId": "%s.OFFER_CLASS_SUFFIX"
+			"id": "%[1]s.OFFER_OBJECT_SUFFIX",
+			"classId": "%[1]s.OFFER_CLASS_SUFFIX"
 		}],
 
 		"transitObjects": [{
-			"id": "%s.TRANSIT_OBJECT_SUFFIX",
-			"classId": "%s.TRANSIT_CLASS_SUFFIX"
+			"id": "%[1]s.TRANSIT_OBJECT_SUFFIX",
+			"classId": "%[1]s.TRANSIT_CLASS_SUFFIX"
 		}]
 	}
 	`, issuerId)), &payload)
@@ -348,4 +651,19 @@ func main() {
 	d.createJwtNewObjects(issuerId, classSuffix, objectSuffix)
 	d.createJwtExistingObjects(issuerId, classSuffix, objectSuffix)
 	d.batchCreateObjects(issuerId, classSuffix)
+
+	customClassSuffix := strings.ReplaceAll(uuid.New().String(), "-", "_")
+	customObjectSuffix := fmt.Sprintf("%s-%s", strings.ReplaceAll(uuid.New().String(), "-", "_"), customClassSuffix)
+	d.createCustomClass(issuerId, customClassSuffix)
+	d.createCustomObject(issuerId, customClassSuffix, customObjectSuffix, "GENERIC_ENTRY_TICKET")
+
+	// Your own issuer can redeem its membership cards
+	redemptionIssuer, err := strconv.ParseInt(issuerId, 10, 64)
+	if err != nil {
+		log.Fatalf("Invalid issuer ID %q: %v", issuerId, err)
+	}
+	membershipClassSuffix := strings.ReplaceAll(uuid.New().String(), "-", "_")
+	d.createMembershipClass(issuerId, membershipClassSuffix, "ONE_USER_ALL_DEVICES", []int64{redemptionIssuer})
+	membershipObjectSuffix := fmt.Sprintf("%s-%s", strings.ReplaceAll(uuid.New().String(), "-", "_"), membershipClassSuffix)
+	d.createMembershipObject(issuerId, membershipClassSuffix, membershipObjectSuffix, "MEMBER-1234")
 }
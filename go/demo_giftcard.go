@@ -1,3 +1,5 @@
+//go:build giftcard
+
 /*
  * Copyright 2023 Google Inc.
  *
@@ -86,10 +88,11 @@ func (d *demoGiftcard) createObject(issuerId, classSuffix, objectSuffix string)
 	giftcardObject.State = "ACTIVE"
 	giftcardObject.CardNumber = "Card number"
 	giftcardObject.Pin = "1234"
-	giftcardObject.Balance = &walletobjects.Money{
-		Micros:       20000000,
-		CurrencyCode: "USD",
+	balance, err := newMoney(20000000, "USD")
+	if err != nil {
+		log.Fatalf("Invalid balance: %v", err)
 	}
+	giftcardObject.Balance = balance
 	giftcardObject.BalanceUpdateTime = &walletobjects.DateTime{
 		Date: "2023-12-12T23:20:50.52Z",
 	}
@@ -150,6 +153,40 @@ func (d *demoGiftcard) createObject(issuerId, classSuffix, objectSuffix string)
 
 // [END createObject]
 
+// Build an amount of money. micros is the amount in millionths of the
+// currency unit, e.g. 20000000 for $20.
+//
+// newMoney and validCurrency are copied as-is between demo_giftcard.go and
+// demo_loyalty.go, since each demo is a standalone package main; keep the
+// copies in sync.
+func newMoney(micros int64, currencyCode string) (*walletobjects.Money, error) {
+	// The API's error for an unknown currency doesn't say which field is
+	// wrong, so the code is checked here first.
+	if !validCurrency(currencyCode) {
+		return nil, fmt.Errorf("invalid currency code %q, must be an ISO 4217 code such as USD", currencyCode)
+	}
+	return &walletobjects.Money{
+		Micros:       micros,
+		CurrencyCode: currencyCode,
+		// Otherwise an amount of zero would be left out of the request
+		ForceSendFields: []string{"Micros"},
+	}, nil
+}
+
+// Report whether code has the form of an ISO 4217 currency code: three
+// uppercase letters.
+func validCurrency(code string) bool {
+	if len(code) != 3 {
+		return false
+	}
+	for _, c := range code {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
 // [START expireObject]
 // Expire an object.
 //
@@ -220,38 +257,38 @@ func (d *demoGiftcard) createJwtExistingObjects(issuerId string, classSuffix str
 	json.Unmarshal([]byte(fmt.Sprintf(`
 	{
 		"eventTicketObjects": [{
-			"id": "%s.EVENT_OBJECT_SUFFIX",
-			"classId": "%s.EVENT_CLASS_SUFFIX"
+			"id": "%[1]s.EVENT_OBJECT_SUFFIX",
+			"classId": "%[1]s.EVENT_CLASS_SUFFIX"
 		}],
 
 		"flightObjects": [{
-			"id": "%s.FLIGHT_OBJECT_SUFFIX",
-			"classId": "%s.FLIGHT_CLASS_SUFFIX"
+			"id": "%[1]s.FLIGHT_OBJECT_SUFFIX",
+			"classId": "%[1]s.FLIGHT_CLASS_SUFFIX"
 		}],
 
 		"genericObjects": [{
-			"id": "%s.GENERIC_OBJECT_SUFFIX",
-			"classId": "%s.GENERIC_CLASS_SUFFIX"
+			"id": "%[1]s.GENERIC_OBJECT_SUFFIX",
+			"classId": "%[1]s.GENERIC_CLASS_SUFFIX"
 		}],
 
 		"giftCardObjects": [{
-			"id": "%s.GIFT_CARD_OBJECT_SUFFIX",
-			"classId": "%s.GIFT_CARD_CLASS_SUFFIX"
+			"id": "%[1]s.GIFT_CARD_OBJECT_SUFFIX",
+			"classId": "%[1]s.GIFT_CARD_CLASS_SUFFIX"
 		}],
 
 		"loyaltyObjects": [{
-			"id": "%s.LOYALTY_OBJECT_SUFFIX",
-			"classId": "%s.LOYALTY_CLASS_SUFFIX"
+			"id": "%[1]s.LOYALTY_OBJECT_SUFFIX",
+			"classId": "%[1]s.LOYALTY_CLASS_SUFFIX"
 		}],
 
 		"giftcardObjects": [{
-			"id": "%s.OFFER_OBJECT_SUFFIX",
-			"classId": "%s.OFFER_CLASS_SUFFIX"
+			"id": "%[1]s.OFFER_OBJECT_SUFFIX",
+			"classId": "%[1]s.OFFER_CLASS_SUFFIX"
 		}],
 
 		"transitObjects": [{
-			"id": "%s.TRANSIT_OBJECT_SUFFIX",
-			"classId": "%s.TRANSIT_CLASS_SUFFIX"
+			"id": "%[1]s.TRANSIT_OBJECT_SUFFIX",
+			"classId": "%[1]s.TRANSIT_CLASS_SUFFIX"
 		}]
 	}
 	`, issuerId)), &payload)
@@ -0,0 +1,54 @@
+//go:build giftcard
+
+/*
+ * Copyright 2023 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"testing"
+)
+
+func TestValidCurrency(t *testing.T) {
+	tests := []struct {
+		code string
+		want bool
+	}{
+		{"USD", true},
+		{"US", false},
+		{"usd", false},
+		{"USDX", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if got := validCurrency(test.code); got != test.want {
+			t.Errorf("validCurrency(%q) = %v, want %v", test.code, got, test.want)
+		}
+	}
+}
+
+func TestNewMoney(t *testing.T) {
+	if _, err := newMoney(20000000, "US"); err == nil {
+		t.Error(`newMoney(20000000, "US") succeeded, want an error`)
+	}
+	money, err := newMoney(0, "USD")
+	if err != nil {
+		t.Fatalf(`newMoney(0, "USD") = %v`, err)
+	}
+	if money.Micros != 0 || money.CurrencyCode != "USD" {
+		t.Errorf(`newMoney(0, "USD") = %+v, want 0 USD`, money)
+	}
+}
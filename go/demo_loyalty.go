@@ -1,3 +1,5 @@
+//go:build loyalty
+
 /*
  * Copyright 2023 Google Inc.
  *
@@ -32,7 +34,9 @@ import (
 	"google.golang.org/api/walletobjects/v1"
 	"io"
 	"log"
+	"net/url"
 	"os"
+	"regexp"
 	"strings"
 )
 
@@ -62,10 +66,18 @@ func (d *demoLoyalty) auth() {
 
 // [START createClass]
 // Create a class.
+//
+// The program name and logo are shown at the top of every card. The
+// labels name the account ID, account name and rewards tier fields of the
+// objects, e.g. "Member ID" rather than the default "Account ID".
 func (d *demoLoyalty) createClass(issuerId, classSuffix string) {
+	logoUri := "https://farm8.staticflickr.com/7340/11177041185_a61a7f2139_o.jpg"
+	if err := validateImageUri(logoUri); err != nil {
+		log.Fatalf("Invalid program logo: %v", err)
+	}
 	logo := walletobjects.Image{
 		SourceUri: &walletobjects.ImageUri{
-			Uri: "http://farm8.staticflickr.com/7340/11177041185_a61a7f2139_o.jpg",
+			Uri: logoUri,
 		},
 	}
 	loyaltyClass := new(walletobjects.LoyaltyClass)
@@ -74,6 +86,10 @@ func (d *demoLoyalty) createClass(issuerId, classSuffix string) {
 	loyaltyClass.IssuerName = "Issuer name"
 	loyaltyClass.ReviewStatus = "UNDER_REVIEW"
 	loyaltyClass.ProgramLogo = &logo
+	loyaltyClass.AccountIdLabel = "Member ID"
+	loyaltyClass.AccountNameLabel = "Member name"
+	loyaltyClass.RewardsTier = "Gold"
+	loyaltyClass.RewardsTierLabel = "Tier"
 	res, err := d.service.Loyaltyclass.Insert(loyaltyClass).Do()
 	if err != nil {
 		log.Fatalf("Unable to insert class: %v", err)
@@ -84,6 +100,19 @@ func (d *demoLoyalty) createClass(issuerId, classSuffix string) {
 
 // [END createClass]
 
+// Check that an image URI can be fetched by Google Wallet: an absolute
+// https URL.
+func validateImageUri(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("image URI %q must be an absolute https URL", uri)
+	}
+	return nil
+}
+
 // [START createObject]
 // Create an object.
 func (d *demoLoyalty) createObject(issuerId, classSuffix, objectSuffix string) {
@@ -97,6 +126,14 @@ func (d *demoLoyalty) createObject(issuerId, classSuffix, objectSuffix string) {
 		Balance: &walletobjects.LoyaltyPointsBalance{Int: 800},
 		Label:   "Points",
 	}
+	// The secondary balance is shown next to the primary one, so it should
+	// only be set on objects that also have loyaltyPoints. If the class
+	// has a card template, it must include both balances for them to be
+	// shown.
+	loyaltyObject.SecondaryLoyaltyPoints = &walletobjects.LoyaltyPoints{
+		Balance: &walletobjects.LoyaltyPointsBalance{Int: 2500},
+		Label:   "Status miles",
+	}
 	loyaltyObject.HeroImage = &walletobjects.Image{
 		SourceUri: &walletobjects.ImageUri{
 			Uri: "https://farm4.staticflickr.com/3723/11177041115_6e6a3b6f49_o.jpg",
@@ -173,6 +210,160 @@ func (d *demoLoyalty) expireObject(issuerId, objectSuffix string) {
 
 // [END expireObject]
 
+// [START updatePoints]
+// Update the loyalty points balance of an object.
+func (d *demoLoyalty) updatePoints(issuerId, objectSuffix string, points int64) {
+	d.patchPoints(issuerId, objectSuffix, false, pointsBalance(points))
+}
+
+// Update the secondary loyalty points balance of an object.
+//
+// Tiered programs can use the secondary balance to track a second
+// currency, such as status miles. The secondary balance is only displayed
+// together with the primary one, so both must be set on the object, and
+// both must be present on the class's card template, if it has one.
+func (d *demoLoyalty) updateSecondaryPoints(issuerId, objectSuffix string, points int64) {
+	d.patchPoints(issuerId, objectSuffix, true, pointsBalance(points))
+}
+
+// Update the balance of an object to an amount of money, for value-based
+// programs such as store credit.
+//
+// A program should keep to one kind of balance: the class doesn't say
+// whether balances are points or money, so objects of the same class with
+// different kinds are shown inconsistently.
+func (d *demoLoyalty) updateMoneyBalance(issuerId, objectSuffix string, micros int64, currencyCode string) {
+	money, err := newMoney(micros, currencyCode)
+	if err != nil {
+		log.Fatalf("Invalid balance: %v", err)
+	}
+	d.patchPoints(issuerId, objectSuffix, false, &walletobjects.LoyaltyPointsBalance{
+		Money: money,
+	})
+}
+
+// [END updatePoints]
+
+// A balance of points.
+func pointsBalance(points int64) *walletobjects.LoyaltyPointsBalance {
+	return &walletobjects.LoyaltyPointsBalance{
+		Int: points,
+		// Otherwise a balance of zero would be left out of the request
+		ForceSendFields: []string{"Int"},
+	}
+}
+
+// Build an amount of money. micros is the amount in millionths of the
+// currency unit, e.g. 20000000 for $20.
+//
+// newMoney and validCurrency are copied as-is between demo_giftcard.go and
+// demo_loyalty.go, since each demo is a standalone package main; keep the
+// copies in sync.
+func newMoney(micros int64, currencyCode string) (*walletobjects.Money, error) {
+	// The API's error for an unknown currency doesn't say which field is
+	// wrong, so the code is checked here first.
+	if !validCurrency(currencyCode) {
+		return nil, fmt.Errorf("invalid currency code %q, must be an ISO 4217 code such as USD", currencyCode)
+	}
+	return &walletobjects.Money{
+		Micros:       micros,
+		CurrencyCode: currencyCode,
+		// Otherwise an amount of zero would be left out of the request
+		ForceSendFields: []string{"Micros"},
+	}, nil
+}
+
+// Report whether code has the form of an ISO 4217 currency code: three
+// uppercase letters.
+func validCurrency(code string) bool {
+	if len(code) != 3 {
+		return false
+	}
+	for _, c := range code {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// Set the primary or secondary balance of an object.
+//
+// The current object is read first, so the label of the balance is kept:
+// patching loyaltyPoints replaces the whole field.
+func (d *demoLoyalty) patchPoints(issuerId, objectSuffix string, secondary bool, balance *walletobjects.LoyaltyPointsBalance) {
+	id := fmt.Sprintf("%s.%s", issuerId, objectSuffix)
+	loyaltyObject, err := d.service.Loyaltyobject.Get(id).Do()
+	if err != nil {
+		log.Fatalf("Unable to get object: %v", err)
+	}
+
+	loyaltyPoints := loyaltyObject.LoyaltyPoints
+	if secondary {
+		loyaltyPoints = loyaltyObject.SecondaryLoyaltyPoints
+	}
+	if loyaltyPoints == nil {
+		loyaltyPoints = new(walletobjects.LoyaltyPoints)
+	}
+	loyaltyPoints.Balance = balance
+
+	patch := new(walletobjects.LoyaltyObject)
+	if secondary {
+		patch.SecondaryLoyaltyPoints = loyaltyPoints
+	} else {
+		patch.LoyaltyPoints = loyaltyPoints
+	}
+	res, err := d.service.Loyaltyobject.Patch(id, patch).Do()
+	if err != nil {
+		log.Fatalf("Unable to patch object: %v", err)
+	} else {
+		fmt.Printf("Object points update id:\n%s\n", res.Id)
+	}
+}
+
+// [START linkOffers]
+// Link offer objects to a loyalty object, so the coupons are shown inside
+// the loyalty card.
+//
+// The linked offers must belong to the same issuer as the loyalty object.
+// The list replaces any offers linked before.
+func (d *demoLoyalty) linkOffers(issuerId, objectSuffix string, offerObjectIds []string) {
+	for _, offerObjectId := range offerObjectIds {
+		if err := validateLinkedOfferId(issuerId, offerObjectId); err != nil {
+			log.Fatalf("Invalid linked offer: %v", err)
+		}
+	}
+
+	patch := &walletobjects.LoyaltyObject{
+		LinkedOfferIds: offerObjectIds,
+		// Otherwise an empty list wouldn't unlink the offers
+		ForceSendFields: []string{"LinkedOfferIds"},
+	}
+	res, err := d.service.Loyaltyobject.Patch(fmt.Sprintf("%s.%s", issuerId, objectSuffix), patch).Do()
+	if err != nil {
+		log.Fatalf("Unable to patch object: %v", err)
+	} else {
+		fmt.Printf("Object linked offers update id:\n%s\n", res.Id)
+	}
+}
+
+// [END linkOffers]
+
+var objectIdPattern = regexp.MustCompile(`^([0-9]+)\.[a-zA-Z0-9._-]+$`)
+
+// Check that an offer object ID is in the form issuerId.objectSuffix, and
+// belongs to the given issuer.
+func validateLinkedOfferId(issuerId, offerObjectId string) error {
+	m := objectIdPattern.FindStringSubmatch(offerObjectId)
+	if m == nil {
+		return fmt.Errorf("%q is not a valid object ID", offerObjectId)
+	}
+	if m[1] != issuerId {
+		return fmt.Errorf("offer object %s belongs to issuer %s, not %s", offerObjectId, m[1], issuerId)
+	}
+	return nil
+}
+
 // [START jwtNew]
 // Generate a signed JWT that creates a new pass class and object.
 //
@@ -225,38 +416,38 @@ func (d *demoLoyalty) createJwtExistingObjects(issuerId string, classSuffix stri
 	json.Unmarshal([]byte(fmt.Sprintf(`
 	{
 		"eventTicketObjects": [{
-			"id": "%s.EVENT_OBJECT_SUFFIX",
-			"classId": "%s.EVENT_CLASS_SUFFIX"
+			"id": "%[1]s.EVENT_OBJECT_SUFFIX",
+			"classId": "%[1]s.EVENT_CLASS_SUFFIX"
 		}],
 
 		"flightObjects": [{
-			"id": "%s.FLIGHT_OBJECT_SUFFIX",
-			"classId": "%s.FLIGHT_CLASS_SUFFIX"
+			"id": "%[1]s.FLIGHT_OBJECT_SUFFIX",
+			"classId": "%[1]s.FLIGHT_CLASS_SUFFIX"
 		}],
 
 		"genericObjects": [{
-			"id": "%s.GENERIC_OBJECT_SUFFIX",
-			"classId": "%s.GENERIC_CLASS_SUFFIX"
+			"id": "%[1]s.GENERIC_OBJECT_SUFFIX",
+			"classId": "%[1]s.GENERIC_CLASS_SUFFIX"
 		}],
 
 		"giftCardObjects": [{
-			"id": "%s.GIFT_CARD_OBJECT_SUFFIX",
-			"classId": "%s.GIFT_CARD_CLASS_SUFFIX"
+			"id": "%[1]s.GIFT_CARD_OBJECT_SUFFIX",
+			"classId": "%[1]s.GIFT_CARD_CLASS_SUFFIX"
 		}],
 
 		"loyaltyObjects": [{
-			"id": "%s.LOYALTY_OBJECT_SUFFIX",
-			"classId": "%s.LOYALTY_CLASS_SUFFIX"
+			"id": "%[1]s.LOYALTY_OBJECT_SUFFIX",
+			"classId": "%[1]s.LOYALTY_CLASS_SUFFIX"
 		}],
 
 		"offerObjects": [{
-			"id": "%s.OFFER_OBJECT_SUFFIX",
-			"classId": "%s.OFFER_CLASS_SUFFIX"
+			"id": "%[1]s.OFFER_OBJECT_SUFFIX",
+			"classId": "%[1]s.OFFER_CLASS_SUFFIX"
 		}],
 
 		"transitObjects": [{
-			"id": "%s.TRANSIT_OBJECT_SUFFIX",
-			"classId": "%s.TRANSIT_CLASS_SUFFIX"
+			"id": "%[1]s.TRANSIT_OBJECT_SUFFIX",
+			"classId": "%[1]s.TRANSIT_CLASS_SUFFIX"
 		}]
 	}
 	`, issuerId)), &payload)
@@ -325,6 +516,12 @@ func main() {
 	d.auth()
 	d.createClass(issuerId, classSuffix)
 	d.createObject(issuerId, classSuffix, objectSuffix)
+	d.updatePoints(issuerId, objectSuffix, 1000)
+	d.updateSecondaryPoints(issuerId, objectSuffix, 3000)
+	// An offer object of the same issuer, e.g. one created by the offer demo
+	if offerObjectId := os.Getenv("WALLET_OFFER_OBJECT_ID"); offerObjectId != "" {
+		d.linkOffers(issuerId, objectSuffix, []string{offerObjectId})
+	}
 	d.expireObject(issuerId, objectSuffix)
 	d.createJwtNewObjects(issuerId, classSuffix, objectSuffix)
 	d.createJwtExistingObjects(issuerId, classSuffix, objectSuffix)
@@ -0,0 +1,136 @@
+//go:build loyalty
+
+/*
+ * Copyright 2023 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"google.golang.org/api/option"
+	"google.golang.org/api/walletobjects/v1"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestValidateLinkedOfferId(t *testing.T) {
+	tests := []struct {
+		name          string
+		offerObjectId string
+		wantErr       bool
+	}{
+		{"same issuer", "3388000000012345678.offer_object", false},
+		{"foreign issuer", "3388000000099999999.offer_object", true},
+		{"no issuer", "offer_object", true},
+		{"empty suffix", "3388000000012345678.", true},
+		{"empty", "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := validateLinkedOfferId("3388000000012345678", test.offerObjectId)
+			if (err != nil) != test.wantErr {
+				t.Errorf("validateLinkedOfferId(%q) = %v, want error: %v", test.offerObjectId, err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidCurrency(t *testing.T) {
+	tests := []struct {
+		code string
+		want bool
+	}{
+		{"USD", true},
+		{"US", false},
+		{"usd", false},
+		{"USDX", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if got := validCurrency(test.code); got != test.want {
+			t.Errorf("validCurrency(%q) = %v, want %v", test.code, got, test.want)
+		}
+	}
+}
+
+func TestNewMoney(t *testing.T) {
+	if _, err := newMoney(20000000, "US"); err == nil {
+		t.Error(`newMoney(20000000, "US") succeeded, want an error`)
+	}
+	money, err := newMoney(0, "USD")
+	if err != nil {
+		t.Fatalf(`newMoney(0, "USD") = %v`, err)
+	}
+	if money.Micros != 0 || money.CurrencyCode != "USD" {
+		t.Errorf(`newMoney(0, "USD") = %+v, want 0 USD`, money)
+	}
+}
+
+// A balance of money replaces the points balance, and keeps its label.
+func TestUpdateMoneyBalance(t *testing.T) {
+	var patch map[string]any
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.Method {
+		case http.MethodGet:
+			json.NewEncoder(w).Encode(&walletobjects.LoyaltyObject{
+				Id: "3388000000012345678.object",
+				LoyaltyPoints: &walletobjects.LoyaltyPoints{
+					Balance: &walletobjects.LoyaltyPointsBalance{Int: 800},
+					Label:   "Store credit",
+				},
+			})
+		case http.MethodPatch:
+			if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+				t.Errorf("decoding patch: %v", err)
+			}
+			json.NewEncoder(w).Encode(&walletobjects.LoyaltyObject{Id: "3388000000012345678.object"})
+		default:
+			t.Errorf("unexpected %s %s", r.Method, r.URL)
+		}
+	}))
+	defer srv.Close()
+	service, err := walletobjects.NewService(context.Background(),
+		option.WithHTTPClient(srv.Client()), option.WithEndpoint(srv.URL+"/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &demoLoyalty{service: service}
+
+	d.updateMoneyBalance("3388000000012345678", "object", 0, "USD")
+
+	loyaltyPoints, _ := patch["loyaltyPoints"].(map[string]any)
+	if loyaltyPoints == nil {
+		t.Fatalf("patch = %v, want loyaltyPoints", patch)
+	}
+	if label := loyaltyPoints["label"]; label != "Store credit" {
+		t.Errorf("label = %v, want Store credit", label)
+	}
+	balance, _ := loyaltyPoints["balance"].(map[string]any)
+	if _, ok := balance["int"]; ok {
+		t.Errorf("balance = %v, want no int", balance)
+	}
+	money, _ := balance["money"].(map[string]any)
+	// micros is an int64, sent as a string
+	if money["micros"] != "0" || money["currencyCode"] != "USD" {
+		t.Errorf("balance.money = %v, want 0 micros of USD", money)
+	}
+	if _, ok := patch["secondaryLoyaltyPoints"]; ok {
+		t.Errorf("patch = %v, want no secondaryLoyaltyPoints", patch)
+	}
+}
@@ -1,3 +1,5 @@
+//go:build offer
+
 /*
  * Copyright 2023 Google Inc.
  *
@@ -19,295 +21,4135 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/csv"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
 	"fmt"
 	"github.com/golang-jwt/jwt"
 	"github.com/google/uuid"
-	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	oauthJwt "golang.org/x/oauth2/jwt"
+	"golang.org/x/text/language"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/option"
 	"google.golang.org/api/walletobjects/v1"
+	"html/template"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
 	"io"
 	"log"
+	"math"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
 	"os"
+	"os/signal"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 // [END imports]
 // [END setup]
 
 type demoOffer struct {
+	// Guards credentials and service when they are replaced by
+	// WatchCredentials. Read them with svc and creds.
+	mu          sync.RWMutex
 	credentials *oauthJwt.Config
 	service     *walletobjects.Service
+
+	// Receives a measurement for every API call. Nil means no metrics are
+	// recorded.
+	metrics Metrics
+
+	// Check classes and objects for missing required fields before
+	// inserting them, instead of relying on the API to reject them.
+	validate bool
+
+	// Public https URL prefix that image URIs are rewritten to go through,
+	// for images that Google can't fetch directly, e.g. on a CDN that needs
+	// authentication. Empty means image URIs are sent as they are.
+	imageProxy string
+
+	// Fetch each image before inserting the class or object, returning an
+	// error for a broken link or a file that isn't an image, and logging
+	// its dimensions with a warning if they don't suit where it's shown.
+	checkImages bool
+
+	// Insert the class and object through the API when a link from
+	// createJwtNewObjects would be too long, and return a link that only
+	// references them instead. This makes API calls, and creates the
+	// object before the user saves it.
+	shortenLongLinks bool
+
+	// Refuse to create objects in a class that hasn't been approved yet.
+	// Objects in a draft or rejected class may not render in the wallet.
+	requireApprovedClass bool
+
+	// Check that the class exists before creating an object in it, so a
+	// mistyped class suffix gets a clear error. Costs an extra API call per
+	// object, so leave it off for bulk inserts into a known class. Implied
+	// by requireApprovedClass.
+	requireExistingClass bool
+
+	// Reject a batch insert if any of its objects already exist, as well as
+	// if an object ID is repeated within the batch, so that nothing is
+	// inserted rather than the batch partially failing. Costs an extra
+	// batch request per insert.
+	checkExistingObjects bool
+
+	// How long "Add to Google Wallet" links stay valid. Zero means the
+	// links never expire.
+	jwtTtl time.Duration
+
+	// Clock for the times in JWT claims, defaulting to time.Now. Tests can
+	// set a fixed clock to get the same JWT every time; RS256 signatures
+	// are deterministic, but ES256 ones aren't.
+	now func() time.Time
+
+	// Record the rate limit and quota headers of API responses, for
+	// LastQuota. Must be set before auth is called.
+	captureQuota bool
+	quota        *quotaRecorder
+
+	// OAuth scopes to request for the service account, for deployments
+	// that restrict them. Defaults to walletobjects.WalletObjectIssuerScope,
+	// currently the only scope the Wallet API defines, which allows both
+	// reading and writing classes and objects; a narrower scope only works
+	// once the API accepts it. Must be set before auth is called.
+	scopes []string
+
+	// User-Agent sent with API requests, including batch requests, so that
+	// traffic from this sample can be told apart in logs and support cases.
+	// Defaults to defaultUserAgent. Must be set before auth is called.
+	userAgent string
+}
+
+// Version of this sample, set at build time with
+// -ldflags "-X main.version=1.2.3".
+var version = "dev"
+
+// The User-Agent sent when demoOffer.userAgent isn't set, naming this
+// sample and its version.
+func defaultUserAgent() string {
+	return "google-wallet-rest-samples-go/" + version
+}
+
+// Errors that callers can check for with errors.Is. The errors returned
+// wrap these along with the details, e.g. the API error.
+var (
+	ErrClassNotFound      = errors.New("class not found")
+	ErrObjectNotFound     = errors.New("object not found")
+	ErrObjectExists       = errors.New("object already exists")
+	ErrClassExists        = errors.New("class already exists")
+	ErrJWTTooLong         = errors.New("save JWT is too long")
+	ErrInvalidID          = errors.New("invalid ID")
+	ErrMissingCredentials = errors.New("GOOGLE_APPLICATION_CREDENTIALS is not set")
+)
+
+// Wrap an API error in notFound if the API returned 404 Not Found, or in
+// exists if it returned 409 Conflict, so callers can tell these apart
+// with errors.Is. Either can be nil to leave that status as it is. The
+// API error can still be unwrapped with errors.As.
+func wrapAPIError(err error, notFound, exists error) error {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) {
+		return err
+	}
+	switch {
+	case apiErr.Code == http.StatusNotFound && notFound != nil:
+		return fmt.Errorf("%w: %w", notFound, err)
+	case apiErr.Code == http.StatusConflict && exists != nil:
+		return fmt.Errorf("%w: %w", exists, err)
+	}
+	return err
+}
+
+// Metrics receives measurements for API operations, so they can be
+// exported to a monitoring system such as Prometheus. Operations are named
+// after the resource and method, e.g. "offerobject.insert".
+type Metrics interface {
+	// Count a successful class or object insert.
+	IncInsert(op string)
+	// Count a failed API call.
+	IncError(op string)
+	// Record the duration of an API call.
+	ObserveLatency(op string, latency time.Duration)
+}
+
+// A Metrics implementation that discards all measurements.
+type noopMetrics struct{}
+
+func (noopMetrics) IncInsert(op string)                             {}
+func (noopMetrics) IncError(op string)                              {}
+func (noopMetrics) ObserveLatency(op string, latency time.Duration) {}
+
+// The configured Metrics, or noopMetrics if there are none.
+func (d *demoOffer) metricsOrNoop() Metrics {
+	if d.metrics == nil {
+		return noopMetrics{}
+	}
+	return d.metrics
+}
+
+// Record the outcome of an API call that started at the given time.
+func (d *demoOffer) observe(op string, start time.Time, err error) {
+	m := d.metricsOrNoop()
+	m.ObserveLatency(op, time.Since(start))
+	if err != nil {
+		m.IncError(op)
+	} else if strings.HasSuffix(op, ".insert") {
+		m.IncInsert(op)
+	}
 }
 
 // [START auth]
 // Create authenticated HTTP client using a service account file.
-func (d *demoOffer) auth() {
+//
+// The key is read from the file GOOGLE_APPLICATION_CREDENTIALS points to,
+// or taken from GOOGLE_APPLICATION_CREDENTIALS_JSON when that is set instead,
+// e.g. in a container that gets its secrets through the environment.
+//
+// Requests go to the production Wallet API unless WALLET_API_ENDPOINT is
+// set to another base URL, e.g. a non-production environment for partners.
+func (d *demoOffer) auth() error {
+	if d.captureQuota && d.quota == nil {
+		d.quota = new(quotaRecorder)
+	}
 	credentialsFile := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
-	b, _ := os.ReadFile(credentialsFile)
-	credentials, err := google.JWTConfigFromJSON(b, walletobjects.WalletObjectIssuerScope)
+	credentialsJson := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS_JSON")
+	var credentials *oauthJwt.Config
+	var service *walletobjects.Service
+	var err error
+	switch {
+	case credentialsFile != "":
+		credentials, service, err = loadCredentials(credentialsFile, d.scopes, d.agent(), d.quota)
+	case credentialsJson != "":
+		credentials, service, err = newCredentials([]byte(credentialsJson), d.scopes, d.agent(), d.quota)
+	default:
+		return fmt.Errorf("%w; set it to the path of a service account key file", ErrMissingCredentials)
+	}
 	if err != nil {
-		fmt.Println(err)
-		log.Fatalf("Unable to load credentials: %v", err)
+		return err
 	}
+	d.mu.Lock()
 	d.credentials = credentials
-	d.service, _ = walletobjects.NewService(context.Background(), option.WithCredentialsFile(credentialsFile))
+	d.service = service
+	d.mu.Unlock()
+	return nil
 }
 
-// [END auth]
+// Load a service account file, and create a service that uses it. If quota
+// isn't nil, the service's responses are passed through it.
+func loadCredentials(credentialsFile string, scopes []string, userAgent string, quota *quotaRecorder) (*oauthJwt.Config, *walletobjects.Service, error) {
+	b, err := os.ReadFile(credentialsFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to read credentials: %w", err)
+	}
+	return newCredentials(b, scopes, userAgent, quota)
+}
 
-// [START createClass]
-// Create a class.
-func (d *demoOffer) createClass(issuerId, classSuffix string) {
-	offerClass := new(walletobjects.OfferClass)
-	offerClass.Id = fmt.Sprintf("%s.%s", issuerId, classSuffix)
-	offerClass.RedemptionChannel = "ONLINE"
-	offerClass.ReviewStatus = "UNDER_REVIEW"
-	offerClass.Title = "Offer title"
-	offerClass.IssuerName = "Issuer name"
-	offerClass.Provider = "Provider name"
-	res, err := d.service.Offerclass.Insert(offerClass).Do()
+// Create a service that uses a service account key with scopes, or the
+// issuer scope if scopes is empty, and sends userAgent with its requests.
+// If quota isn't nil, the service's responses are passed through it.
+func newCredentials(b []byte, scopes []string, userAgent string, quota *quotaRecorder) (*oauthJwt.Config, *walletobjects.Service, error) {
+	if err := checkServiceAccountType(b); err != nil {
+		return nil, nil, err
+	}
+	if len(scopes) == 0 {
+		scopes = []string{walletobjects.WalletObjectIssuerScope}
+	}
+	credentials, err := google.JWTConfigFromJSON(b, scopes...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to load credentials: %w", err)
+	}
+	if err := validateServiceAccount(credentials); err != nil {
+		return nil, nil, err
+	}
+
+	opts := []option.ClientOption{option.WithCredentialsJSON(b), option.WithScopes(scopes...), option.WithUserAgent(userAgent)}
+	if quota != nil {
+		// WithUserAgent doesn't apply to a client passed in with
+		// WithHTTPClient, so the client sets the header itself.
+		client := credentials.Client(context.Background())
+		client.Transport = quota.wrap(withUserAgent(client.Transport, userAgent))
+		opts = []option.ClientOption{option.WithHTTPClient(client)}
+	}
+	if endpoint := os.Getenv("WALLET_API_ENDPOINT"); endpoint != "" {
+		opts = append(opts, option.WithEndpoint(endpoint))
+	}
+	service, err := walletobjects.NewService(context.Background(), opts...)
 	if err != nil {
-		log.Fatalf("Unable to insert class: %v", err)
-	} else {
-		fmt.Printf("Class insert id:\n%v\n", res.Id)
+		return nil, nil, fmt.Errorf("unable to create service: %w", err)
 	}
+	return credentials, service, nil
 }
 
-// [END createClass]
+// [END auth]
 
-// [START createObject]
-// Create an object.
-func (d *demoOffer) createObject(issuerId, classSuffix, objectSuffix string) {
-	offerObject := new(walletobjects.OfferObject)
-	offerObject.Id = fmt.Sprintf("%s.%s", issuerId, objectSuffix)
-	offerObject.ClassId = fmt.Sprintf("%s.%s", issuerId, classSuffix)
-	offerObject.State = "ACTIVE"
-	offerObject.ValidTimeInterval = &walletobjects.TimeInterval{
-		Start: &walletobjects.DateTime{
-			Date: "2023-06-12T23:20:50.52Z",
-		},
-		End: &walletobjects.DateTime{
-			Date: "2023-12-12T23:20:50.52Z",
-		},
+// The current service, which WatchCredentials may replace at any time.
+// Don't hold on to it across calls.
+func (d *demoOffer) svc() *walletobjects.Service {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.service
+}
+
+// The current credentials, which WatchCredentials may replace at any
+// time. Don't hold on to them across calls.
+func (d *demoOffer) creds() *oauthJwt.Config {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.credentials
+}
+
+// The User-Agent to send, from d.userAgent or defaultUserAgent if it isn't
+// set.
+func (d *demoOffer) agent() string {
+	if d.userAgent != "" {
+		return d.userAgent
 	}
-	offerObject.HeroImage = &walletobjects.Image{
-		SourceUri: &walletobjects.ImageUri{
-			Uri: "https://farm4.staticflickr.com/3723/11177041115_6e6a3b6f49_o.jpg",
-		},
+	return defaultUserAgent()
+}
+
+// An HTTP client authorized with d.credentials that sends d's User-Agent,
+// for requests that don't go through the service, e.g. batch requests.
+func (d *demoOffer) httpClient(ctx context.Context) *http.Client {
+	client := d.creds().Client(ctx)
+	client.Transport = withUserAgent(client.Transport, d.agent())
+	return client
+}
+
+// A round tripper that sends requests with base, setting their User-Agent
+// header.
+type userAgentRoundTripper struct {
+	base      http.RoundTripper
+	userAgent string
+}
+
+func withUserAgent(base http.RoundTripper, userAgent string) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
 	}
-	offerObject.Barcode = &walletobjects.Barcode{
-		Type:  "QR_CODE",
-		Value: "QR code",
+	return &userAgentRoundTripper{base: base, userAgent: userAgent}
+}
+
+func (rt *userAgentRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A round tripper mustn't modify the request it's given
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", rt.userAgent)
+	return rt.base.RoundTrip(req)
+}
+
+// Check that a credentials file is a service account key.
+//
+// User OAuth credentials, e.g. from "gcloud auth application-default
+// login", can't sign save JWTs or call the API as the issuer.
+func checkServiceAccountType(b []byte) error {
+	var file struct {
+		Type string `json:"type"`
 	}
-	offerObject.Locations = []*walletobjects.LatLongPoint{
-		&walletobjects.LatLongPoint{
-			Latitude:  37.424015499999996,
-			Longitude: -122.09259560000001,
-		},
+	if err := json.Unmarshal(b, &file); err != nil {
+		return fmt.Errorf("credentials file is not valid JSON: %w", err)
 	}
-	offerObject.LinksModuleData = &walletobjects.LinksModuleData{
-		Uris: []*walletobjects.Uri{
-			&walletobjects.Uri{
-				Id:          "LINK_MODULE_URI_ID",
-				Uri:         "http://maps.google.com/",
-				Description: "Link module URI description",
-			},
-			&walletobjects.Uri{
-				Id:          "LINK_MODULE_TEL_ID",
-				Uri:         "tel:6505555555",
-				Description: "Link module tel description",
-			},
-		},
+	if file.Type != "service_account" {
+		return fmt.Errorf("credentials file has type %q, expected a service account key "+
+			"(type \"service_account\"); user OAuth credentials can't be used", file.Type)
 	}
-	offerObject.ImageModulesData = []*walletobjects.ImageModuleData{
-		&walletobjects.ImageModuleData{
-			Id: "IMAGE_MODULE_ID",
-			MainImage: &walletobjects.Image{
-				SourceUri: &walletobjects.ImageUri{
-					Uri: "http://farm4.staticflickr.com/3738/12440799783_3dc3c20606_b.jpg",
-				},
-			},
-		},
+	return nil
+}
+
+// Check that loaded credentials have what a service account key needs.
+func validateServiceAccount(credentials *oauthJwt.Config) error {
+	if credentials.Email == "" {
+		return errors.New("credentials file has no client_email, it doesn't look like a service account key")
 	}
-	offerObject.TextModulesData = []*walletobjects.TextModuleData{
-		&walletobjects.TextModuleData{
-			Body:   "Text module body",
-			Header: "Text module header",
-			Id:     "TEXT_MODULE_ID",
-		},
+	if len(credentials.PrivateKey) == 0 {
+		return errors.New("credentials file has no private_key, it doesn't look like a service account key")
+	}
+	tokenUrl, err := url.Parse(credentials.TokenURL)
+	if err != nil || tokenUrl.Scheme != "https" ||
+		(tokenUrl.Host != "oauth2.googleapis.com" && tokenUrl.Host != "accounts.google.com") {
+		return fmt.Errorf("credentials file has token_uri %q, expected Google's token endpoint %s", credentials.TokenURL, google.JWTTokenURL)
+	}
+	return nil
+}
+
+// [START quota]
+// Rate limit and quota headers of an API response.
+type Quota struct {
+	// The X-RateLimit-*, X-Quota-* and Retry-After headers of the response
+	Header http.Header
+	// When the response was received
+	Received time.Time
+}
+
+// Records the quota headers of the last response that had any.
+type quotaRecorder struct {
+	mu   sync.Mutex
+	last Quota
+}
+
+// A round tripper that sends requests with base and records the quota
+// headers of the responses.
+type quotaRoundTripper struct {
+	base  http.RoundTripper
+	quota *quotaRecorder
+}
+
+func (q *quotaRecorder) wrap(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
 	}
+	return &quotaRoundTripper{base: base, quota: q}
+}
 
-	res, err := d.service.Offerobject.Insert(offerObject).Do()
+func (rt *quotaRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := rt.base.RoundTrip(req)
 	if err != nil {
-		log.Fatalf("Unable to insert object: %v", err)
-	} else {
-		fmt.Printf("Object insert id:\n%s\n", res.Id)
+		return res, err
 	}
+	header := make(http.Header)
+	for name, values := range res.Header {
+		if strings.HasPrefix(name, "X-Ratelimit-") || strings.HasPrefix(name, "X-Quota-") || name == "Retry-After" {
+			header[name] = values
+		}
+	}
+	if len(header) > 0 {
+		rt.quota.mu.Lock()
+		rt.quota.last = Quota{Header: header, Received: time.Now()}
+		rt.quota.mu.Unlock()
+	}
+	return res, nil
 }
 
-// [END createObject]
+// Get the quota headers of the most recent API response that had any.
+//
+// The client library doesn't expose response headers, so they are only
+// recorded if captureQuota was set before auth. Callers can use them to
+// pace requests before the API starts returning 429 errors. The zero
+// Quota is returned if no headers have been seen.
+func (d *demoOffer) LastQuota() Quota {
+	if d.quota == nil {
+		return Quota{}
+	}
+	d.quota.mu.Lock()
+	defer d.quota.mu.Unlock()
+	return d.quota.last
+}
 
-// [START expireObject]
-// Expire an object.
+// [END quota]
+
+// [START watchCredentials]
+// How often WatchCredentials checks the credentials file for changes.
+var credentialsPollInterval = 10 * time.Second
+
+// Reload the credentials whenever the service account file changes.
 //
-// Sets the object's state to Expired. If the valid time interval is
-// already set, the pass will expire automatically up to 24 hours after.
-func (d *demoOffer) expireObject(issuerId, objectSuffix string) {
-	offerObject := &walletobjects.OfferObject{
-		State: "EXPIRED",
+// This is for long-running servers whose credentials are mounted from a
+// secret that is rotated, e.g. by Kubernetes. The file is polled, and when
+// its modification time or size changes the credentials and service are
+// replaced together while holding d.mu. Every method reads them through
+// svc and creds, so it's safe to keep using d while the watcher runs;
+// requests already in flight finish with the old credentials.
+//
+// Errors loading the new file are sent on the returned channel, and the
+// previous credentials are kept. The stop function ends the watch and
+// closes the channel.
+func (d *demoOffer) WatchCredentials(path string) (<-chan error, func()) {
+	errs := make(chan error, 1)
+	done := make(chan struct{})
+	// Stat the file before returning, so any change after the call is seen
+	last, _ := os.Stat(path)
+
+	go func() {
+		defer close(errs)
+		ticker := time.NewTicker(credentialsPollInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			info, err := os.Stat(path)
+			if err != nil {
+				// The file may be briefly missing while the secret is
+				// replaced; report it and try again on the next tick.
+				select {
+				case errs <- fmt.Errorf("unable to stat credentials: %w", err):
+				case <-done:
+					return
+				}
+				continue
+			}
+			if last != nil && info.ModTime().Equal(last.ModTime()) && info.Size() == last.Size() {
+				continue
+			}
+			last = info
+
+			credentials, service, err := loadCredentials(path, d.scopes, d.agent(), d.quota)
+			if err != nil {
+				select {
+				case errs <- err:
+				case <-done:
+					return
+				}
+				continue
+			}
+			d.mu.Lock()
+			d.credentials = credentials
+			d.service = service
+			d.mu.Unlock()
+		}
+	}()
+
+	var once sync.Once
+	return errs, func() { once.Do(func() { close(done) }) }
+}
+
+// [END watchCredentials]
+
+// [START checkPermissions]
+// Check that the service account can manage passes for the issuer.
+//
+// A single class is listed, which fails if the account can't read the
+// issuer's classes. The API rejects bad credentials with 401, and an
+// account without access to the issuer with 403, so the two are reported
+// separately.
+func (d *demoOffer) checkPermissions(ctx context.Context, issuerId string) error {
+	id, err := strconv.ParseInt(issuerId, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid issuer ID %q: %w", issuerId, err)
+	}
+	start := time.Now()
+	_, err = d.svc().Offerclass.List().IssuerId(id).MaxResults(1).Context(ctx).Do()
+	d.observe("offerclass.list", start, err)
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		switch apiErr.Code {
+		case http.StatusUnauthorized:
+			return fmt.Errorf("credentials were rejected, check GOOGLE_APPLICATION_CREDENTIALS: %w", err)
+		case http.StatusForbidden:
+			return fmt.Errorf("service account has no access to issuer %s; add it as a user "+
+				"on the Users page of the Google Pay & Wallet Console "+
+				"(https://pay.google.com/business/console): %w", issuerId, err)
+		}
 	}
-	res, err := d.service.Offerobject.Patch(fmt.Sprintf("%s.%s", issuerId, objectSuffix), offerObject).Do()
 	if err != nil {
-		log.Fatalf("Unable to patch object: %v", err)
-	} else {
-		fmt.Printf("Object expiration id:\n%s\n", res.Id)
+		return fmt.Errorf("unable to check permissions: %w", err)
 	}
+	return nil
 }
 
-// [END expireObject]
+// [END checkPermissions]
 
-// [START jwtNew]
-// Generate a signed JWT that creates a new pass class and object.
-//
-// When the user opens the "Add to Google Wallet" URL and saves the pass to
-// their wallet, the pass class and object defined in the JWT are
-// created. This allows you to create multiple pass classes and objects in
-// one API call when the user saves the pass to their wallet.
-func (d *demoOffer) createJwtNewObjects(issuerId, classSuffix, objectSuffix string) {
-	offerObject := new(walletobjects.OfferObject)
-	offerObject.Id = fmt.Sprintf("%s.%s", issuerId, objectSuffix)
-	offerObject.ClassId = fmt.Sprintf("%s.%s", issuerId, classSuffix)
-	offerObject.State = "ACTIVE"
+// Settings for an offer class, for createClass, createClassAndGet and
+// createJwtNewObjects.
+type OfferClassConfig struct {
+	Title      string
+	IssuerName string
+	Provider   string
 
-	offerJson, _ := json.Marshal(offerObject)
-	var payload map[string]any
-	json.Unmarshal([]byte(fmt.Sprintf(`
-	{
-		"offerObjects": [%s]
+	// Where the offer is redeemed: INSTORE, ONLINE or BOTH for offers the
+	// user redeems with a code, or TEMPORARY_PRICE_REDUCTION for a price
+	// cut applied automatically at the till, with nothing to redeem. A
+	// price reduction must describe the reduction in Details, and can't
+	// use smart tap.
+	RedemptionChannel string
+	// Description of the offer, shown on the back of the pass
+	Details string
+	// Terms and conditions of the offer
+	FinePrint string
+
+	// Translations of the issuer and provider names. The plain names are
+	// still required, and are shown wherever the localized ones aren't
+	// supported; elsewhere the localized names take precedence.
+	LocalizedIssuerName *walletobjects.LocalizedString
+	LocalizedProvider   *walletobjects.LocalizedString
+
+	// Wide logo shown at the top of the pass, in place of the title
+	WideLogo *walletobjects.Image
+	// Banner image shown on every object of the class. An object's own
+	// heroImage takes precedence over the class image.
+	HeroImage *walletobjects.Image
+
+	// Layout of the fields on the pass
+	ClassTemplateInfo *walletobjects.ClassTemplateInfo
+
+	// Smart Tap lets NFC terminals read the pass. RedemptionIssuers lists
+	// the collector IDs of the issuers allowed to redeem it, and must not be
+	// empty when smart tap is enabled. Your collector ID is shown in the
+	// Google Pay & Wallet Console under Google Wallet API > Smart Tap.
+	EnableSmartTap    bool
+	RedemptionIssuers []int64
+
+	// Animation shown over the barcode to show the pass is genuine and not
+	// a screenshot, e.g. FOIL_SHIMMER. It's only shown on objects with a
+	// rotating barcode.
+	SecurityAnimation string
+
+	// Set to UNLOCK_REQUIRED_TO_VIEW to make users unlock their device
+	// each time they open the pass, e.g. for high-value offers. Users
+	// without a screen lock are asked to set one up before the pass is
+	// shown. Defaults to UNLOCK_NOT_REQUIRED.
+	ViewUnlockRequirement string
+
+	// Background color of the pass, either as #RRGGBB or as a CSS color
+	// name such as "navy". Defaults to a color taken from the logo.
+	BackgroundColor string
+
+	// ISO 3166-1 alpha-2 code of the country the offer is for, e.g. "US".
+	// The country is shown to users outside it, and its language is used
+	// for content that isn't translated into the user's language.
+	CountryCode string
+}
+
+// The class settings used throughout the demo.
+func demoOfferClassConfig() *OfferClassConfig {
+	return &OfferClassConfig{
+		Title:             "Offer title",
+		IssuerName:        "Issuer name",
+		Provider:          "Provider name",
+		RedemptionChannel: "ONLINE",
+		WideLogo:          newImage("http://farm8.staticflickr.com/7340/11177041185_a61a7f2139_o.jpg", "Issuer logo"),
+		HeroImage:         newImage("https://farm4.staticflickr.com/3723/11177041115_6e6a3b6f49_o.jpg", "Offer banner"),
+		ClassTemplateInfo: demoClassTemplateInfo(),
 	}
-	`, offerJson)), &payload)
-	claims := jwt.MapClaims{
-		"iss":     d.credentials.Email,
-		"aud":     "google",
-		"origins": []string{"www.example.com"},
-		"typ":     "savetowallet",
-		"payload": payload,
+}
+
+// Class settings for a temporary price reduction, e.g. a grocery
+// retailer's weekly deal.
+func demoPriceReductionClassConfig() *OfferClassConfig {
+	return &OfferClassConfig{
+		Title:             "20% off fresh produce",
+		IssuerName:        "Issuer name",
+		Provider:          "Provider name",
+		RedemptionChannel: "TEMPORARY_PRICE_REDUCTION",
+		Details:           "20% off all fresh produce this week. The reduction is applied automatically at checkout.",
+		FinePrint:         "Valid in participating stores only.",
 	}
+}
 
-	// The service account credentials are used to sign the JWT
-	key, _ := jwt.ParseRSAPrivateKeyFromPEM(d.credentials.PrivateKey)
-	token, _ := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(key)
+// [START classTemplateInfo]
+// Build a class template that customizes the layout of the pass.
+//
+// Template items reference values on the class or object by field path.
+// Here the text module created by createObject is shown in a row on the
+// front of the card, and again above the barcode.
+func demoClassTemplateInfo() *walletobjects.ClassTemplateInfo {
+	textModule := fieldSelector("object.textModulesData['TEXT_MODULE_ID']")
+	return &walletobjects.ClassTemplateInfo{
+		CardTemplateOverride: &walletobjects.CardTemplateOverride{
+			CardRowTemplateInfos: []*walletobjects.CardRowTemplateInfo{
+				&walletobjects.CardRowTemplateInfo{
+					OneItem: &walletobjects.CardRowOneItem{
+						Item: &walletobjects.TemplateItem{
+							FirstValue: textModule,
+						},
+					},
+				},
+			},
+		},
+		CardBarcodeSectionDetails: &walletobjects.CardBarcodeSectionDetails{
+			FirstTopDetail: &walletobjects.BarcodeSectionDetail{
+				FieldSelector: textModule,
+			},
+		},
+	}
+}
 
-	fmt.Println("Add to Google Wallet link")
-	fmt.Println("https://pay.google.com/gp/v/save/" + token)
+// Build a selector for the field at the given path, e.g.
+// "class.localizedIssuerName" or "object.textModulesData['ID']".
+func fieldSelector(fieldPath string) *walletobjects.FieldSelector {
+	return &walletobjects.FieldSelector{
+		Fields: []*walletobjects.FieldReference{
+			&walletobjects.FieldReference{
+				FieldPath: fieldPath,
+			},
+		},
+	}
 }
 
-// [END jwtNew]
+// [END classTemplateInfo]
 
-// [START jwtExisting]
-// Generate a signed JWT that references an existing pass object.
+// Build the class described by the config.
+//
+// Settings that are always invalid, whatever else is set, are checked here
+// so that every way of creating a class rejects them.
+func (c *OfferClassConfig) offerClass(id string) (*walletobjects.OfferClass, error) {
+	offerClass := new(walletobjects.OfferClass)
+	offerClass.Id = id
+	offerClass.RedemptionChannel = c.RedemptionChannel
+	offerClass.ReviewStatus = string(ReviewUnderReview)
+	offerClass.Title = c.Title
+	offerClass.IssuerName = c.IssuerName
+	offerClass.Provider = c.Provider
+	offerClass.Details = c.Details
+	offerClass.FinePrint = c.FinePrint
+	offerClass.LocalizedIssuerName = c.LocalizedIssuerName
+	offerClass.LocalizedProvider = c.LocalizedProvider
+	offerClass.WideTitleImage = c.WideLogo
+	offerClass.HeroImage = c.HeroImage
+	offerClass.ClassTemplateInfo = c.ClassTemplateInfo
+	offerClass.EnableSmartTap = c.EnableSmartTap
+	offerClass.RedemptionIssuers = c.RedemptionIssuers
+	offerClass.ViewUnlockRequirement = c.ViewUnlockRequirement
+	if err := validateSmartTap(offerClass); err != nil {
+		return nil, err
+	}
+	switch c.SecurityAnimation {
+	case "":
+	case "ANIMATION_UNSPECIFIED", "FOIL_SHIMMER":
+		offerClass.SecurityAnimation = &walletobjects.SecurityAnimation{
+			AnimationType: c.SecurityAnimation,
+		}
+	default:
+		return nil, fmt.Errorf("class %s has unknown security animation %q", id, c.SecurityAnimation)
+	}
+	switch c.ViewUnlockRequirement {
+	case "", "VIEW_UNLOCK_REQUIREMENT_UNSPECIFIED", "UNLOCK_NOT_REQUIRED", "UNLOCK_REQUIRED_TO_VIEW":
+	default:
+		return nil, fmt.Errorf("class %s has unknown view unlock requirement %q", id, c.ViewUnlockRequirement)
+	}
+	if c.BackgroundColor != "" {
+		hexColor, err := parseColor(c.BackgroundColor)
+		if err != nil {
+			return nil, err
+		}
+		offerClass.HexBackgroundColor = hexColor
+	}
+	if c.CountryCode != "" {
+		if err := validateCountryCode(c.CountryCode); err != nil {
+			return nil, err
+		}
+		offerClass.CountryCode = c.CountryCode
+	}
+	return offerClass, nil
+}
 
-// When the user opens the "Add to Google Wallet" URL and saves the pass to
-// their wallet, the pass objects defined in the JWT are added to the
-// user's Google Wallet app. This allows the user to save multiple pass
-// objects in one API call.
-func (d *demoOffer) createJwtExistingObjects(issuerId string, classSuffix string, objectSuffix string) {
-	var payload map[string]interface{}
-	json.Unmarshal([]byte(fmt.Sprintf(`
-	{
-		"eventTicketObjects": [{
-			"id": "%s.EVENT_OBJECT_SUFFIX",
-			"classId": "%s.EVENT_CLASS_SUFFIX"
-		}],
+// Check that a country code is an ISO 3166-1 alpha-2 code, e.g. "US".
+func validateCountryCode(countryCode string) error {
+	region, err := language.ParseRegion(countryCode)
+	if err != nil || len(countryCode) != 2 || !region.IsCountry() {
+		return fmt.Errorf("country code %q is not an ISO 3166-1 alpha-2 code", countryCode)
+	}
+	return nil
+}
 
-		"flightObjects": [{
-			"id": "%s.FLIGHT_OBJECT_SUFFIX",
-			"classId": "%s.FLIGHT_CLASS_SUFFIX"
-		}],
+// CSS color names accepted for the background color, e.g. for
+// marketers who know colors by name rather than by hex code.
+var namedColors = map[string]string{
+	"black":   "#000000",
+	"silver":  "#c0c0c0",
+	"gray":    "#808080",
+	"grey":    "#808080",
+	"white":   "#ffffff",
+	"maroon":  "#800000",
+	"red":     "#ff0000",
+	"purple":  "#800080",
+	"fuchsia": "#ff00ff",
+	"green":   "#008000",
+	"lime":    "#00ff00",
+	"olive":   "#808000",
+	"yellow":  "#ffff00",
+	"navy":    "#000080",
+	"blue":    "#0000ff",
+	"teal":    "#008080",
+	"aqua":    "#00ffff",
+	"orange":  "#ffa500",
+}
 
-		"genericObjects": [{
-			"id": "%s.GENERIC_OBJECT_SUFFIX",
-			"classId": "%s.GENERIC_CLASS_SUFFIX"
-		}],
+var hexColorPattern = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
 
-		"giftCardObjects": [{
-			"id": "%s.GIFT_CARD_OBJECT_SUFFIX",
-			"classId": "%s.GIFT_CARD_CLASS_SUFFIX"
-		}],
+// Convert a color given as #RRGGBB or as a name in namedColors to the
+// #RRGGBB form the API expects.
+func parseColor(color string) (string, error) {
+	if hexColorPattern.MatchString(color) {
+		return color, nil
+	}
+	if hexColor, ok := namedColors[strings.ToLower(strings.TrimSpace(color))]; ok {
+		return hexColor, nil
+	}
+	return "", fmt.Errorf("unknown color %q, expected #RRGGBB or a color name such as navy", color)
+}
 
-		"loyaltyObjects": [{
-			"id": "%s.LOYALTY_OBJECT_SUFFIX",
-			"classId": "%s.LOYALTY_CLASS_SUFFIX"
-		}],
+// The outcome of a demo operation.
+type Result struct {
+	// The operation, e.g. "class.insert", "object.insert" or "jwt.new"
+	Op string
+	// ID of the class or object, if the operation has one
+	ID string
+	// "Add to Google Wallet" link, for the JWT operations
+	URL string
+}
 
-		"offerObjects": [{
-			"id": "%s.OFFER_OBJECT_SUFFIX",
-			"classId": "%s.OFFER_CLASS_SUFFIX"
-		}],
+func (r *Result) String() string {
+	s := r.Op
+	if r.ID != "" {
+		s += " id: " + r.ID
+	}
+	if r.URL != "" {
+		s += " link: " + r.URL
+	}
+	return s
+}
 
-		"transitObjects": [{
-			"id": "%s.TRANSIT_OBJECT_SUFFIX",
-			"classId": "%s.TRANSIT_CLASS_SUFFIX"
-		}]
+// [START createClass]
+// Create a class with the settings in config, or the demo settings if
+// config is nil.
+func (d *demoOffer) createClass(issuerId, classSuffix string, config *OfferClassConfig) (*Result, error) {
+	res, err := d.insertClass(issuerId, classSuffix, config)
+	if err != nil {
+		return nil, err
 	}
-	`, issuerId)), &payload)
+	return &Result{Op: "class.insert", ID: res.Id}, nil
+}
 
-	claims := jwt.MapClaims{
-		"iss":     d.credentials.Email,
-		"aud":     "google",
-		"origins": []string{"www.example.com"},
-		"typ":     "savetowallet",
-		"payload": payload,
+// Create a class, and read it back to see what was stored.
+//
+// The class as stored includes the defaults the API fills in for fields
+// that weren't sent, which shows how partial settings were interpreted.
+// This costs a second API call, so use createClass when only the ID is
+// needed.
+func (d *demoOffer) createClassAndGet(issuerId, classSuffix string, config *OfferClassConfig) (*walletobjects.OfferClass, error) {
+	res, err := d.insertClass(issuerId, classSuffix, config)
+	if err != nil {
+		return nil, err
 	}
+	var offerClass *walletobjects.OfferClass
+	err = retryIdempotent(func() error {
+		start := time.Now()
+		offerClass, err = d.svc().Offerclass.Get(res.Id).Do()
+		d.observe("offerclass.get", start, err)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to get class %s: %w", res.Id, wrapAPIError(err, ErrClassNotFound, nil))
+	}
+	return offerClass, nil
+}
 
-	// The service account credentials are used to sign the JWT
-	key, _ := jwt.ParseRSAPrivateKeyFromPEM(d.credentials.PrivateKey)
-	token, _ := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(key)
+// Insert the class described by config, or the demo class if config is
+// nil, returning the API's response.
+func (d *demoOffer) insertClass(issuerId, classSuffix string, config *OfferClassConfig) (*walletobjects.OfferClass, error) {
+	id, err := classId(issuerId, classSuffix)
+	if err != nil {
+		return nil, fmt.Errorf("invalid class ID: %w", err)
+	}
+	if config == nil {
+		config = demoOfferClassConfig()
+	}
+	offerClass, err := config.offerClass(id)
+	if err != nil {
+		return nil, fmt.Errorf("invalid class: %w", err)
+	}
+	if err := d.proxyImages(&offerClass.WideTitleImage, &offerClass.HeroImage); err != nil {
+		return nil, err
+	}
+	if d.checkImages {
+		if err := checkImage("wideTitleImage", offerClass.WideTitleImage); err != nil {
+			return nil, err
+		}
+		if err := checkImage("heroImage", offerClass.HeroImage); err != nil {
+			return nil, err
+		}
+	}
+	if d.validate {
+		if err := validateOfferClass(offerClass); err != nil {
+			return nil, fmt.Errorf("invalid class: %w", err)
+		}
+	}
+	start := time.Now()
+	res, err := d.svc().Offerclass.Insert(offerClass).Do()
+	d.observe("offerclass.insert", start, err)
+	if err != nil {
+		return nil, fmt.Errorf("unable to insert class: %w", wrapAPIError(err, nil, ErrClassExists))
+	}
+	return res, nil
+}
+
+// [END createClass]
 
-	fmt.Println("Add to Google Wallet link")
-	fmt.Println("https://pay.google.com/gp/v/save/" + token)
+// [START getClassReviewStatus]
+// Get the review status of a class.
+func (d *demoOffer) getClassReviewStatus(ctx context.Context, issuerId, classSuffix string) (ReviewStatus, error) {
+	id, err := classId(issuerId, classSuffix)
+	if err != nil {
+		return "", err
+	}
+	var offerClass *walletobjects.OfferClass
+	err = retryIdempotent(func() error {
+		start := time.Now()
+		offerClass, err = d.svc().Offerclass.Get(id).Fields("reviewStatus").Context(ctx).Do()
+		d.observe("offerclass.get", start, err)
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to get class %s: %w", id, wrapAPIError(err, ErrClassNotFound, nil))
+	}
+	return ReviewStatus(offerClass.ReviewStatus), nil
 }
 
-// [END jwtExisting]
+// [END getClassReviewStatus]
 
-// [START batch]
-// Batch create Google Wallet objects from an existing class.
-func (d *demoOffer) batchCreateObjects(issuerId, classSuffix string) {
-	data := ""
-	for i := 0; i < 3; i++ {
-		objectSuffix := strings.ReplaceAll(uuid.New().String(), "-", "_")
+// [START watchReview]
+// Poll the review status of a class until it's approved.
+//
+// Each change of status is written to w. Polling stops with an error if
+// the class is rejected or ctx is done, e.g. when a timeout passes.
+func (d *demoOffer) watchReview(ctx context.Context, issuerId, classSuffix string, interval time.Duration, w io.Writer) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 
-		offerObject := new(walletobjects.OfferObject)
-		offerObject.Id = fmt.Sprintf("%s.%s", issuerId, objectSuffix)
-		offerObject.ClassId = fmt.Sprintf("%s.%s", issuerId, classSuffix)
-		offerObject.State = "ACTIVE"
+	var last ReviewStatus
+	for {
+		status, err := d.getClassReviewStatus(ctx, issuerId, classSuffix)
+		if err != nil {
+			return err
+		}
+		if status != last {
+			fmt.Fprintf(w, "%s %s\n", time.Now().Format(time.RFC3339), status)
+			last = status
+		}
+		switch status {
+		case ReviewApproved:
+			return nil
+		case ReviewRejected:
+			return fmt.Errorf("class %s.%s was rejected", issuerId, classSuffix)
+		}
 
-		offerJson, _ := json.Marshal(offerObject)
-		batchObject := fmt.Sprintf("%s", offerJson)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("stopped waiting for approval: %w", ctx.Err())
+		case <-ticker.C:
+		}
+	}
+}
+
+// Run the watch-review command: wait for a class to be approved.
+func watchReviewCommand(d *demoOffer, issuerId string, args []string) error {
+	flags := flag.NewFlagSet("watch-review", flag.ExitOnError)
+	classSuffix := flags.String("class", "", "suffix of the class to watch (required)")
+	interval := flags.Duration("interval", 30*time.Second, "time between checks")
+	timeout := flags.Duration("timeout", time.Hour, "how long to wait for approval, 0 for no limit")
+	flags.Parse(args)
+	if *classSuffix == "" {
+		flags.Usage()
+		return errors.New("-class is required")
+	}
 
-		data += "--batch_createobjectbatch\n"
-		data += "Content-Type: application/json\n\n"
-		data += "POST /walletobjects/v1/offerObject\n\n"
-		data += batchObject + "\n\n"
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if *timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+		defer cancel()
 	}
-	data += "--batch_createobjectbatch--"
+	return d.watchReview(ctx, issuerId, *classSuffix, *interval, os.Stdout)
+}
 
-	res, err := d.credentials.Client(oauth2.NoContext).Post("https://walletobjects.googleapis.com/batch", "multipart/mixed; boundary=batch_createobjectbatch", bytes.NewBuffer([]byte(data)))
+// [END watchReview]
 
+// [START cloneClass]
+// Copy an existing class to a new class suffix.
+//
+// Fields assigned by the server (review comments, version and kind) are
+// cleared, as they can't be sent on insert. The copy starts a new review
+// regardless of the source class's review status.
+func (d *demoOffer) cloneClass(issuerId, srcSuffix, dstSuffix string) (*walletobjects.OfferClass, error) {
+	srcId, err := classId(issuerId, srcSuffix)
 	if err != nil {
-		fmt.Println(err)
-	} else {
-		b, _ := io.ReadAll(res.Body)
-		fmt.Printf("Batch insert response:\n%s\n", b)
+		return nil, err
+	}
+	dstId, err := classId(issuerId, dstSuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	offerClass, err := d.svc().Offerclass.Get(srcId).Do()
+	d.observe("offerclass.get", start, err)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get class %s: %w", srcId, wrapAPIError(err, ErrClassNotFound, nil))
 	}
+	offerClass.ServerResponse = googleapi.ServerResponse{}
+	offerClass.Id = dstId
+	offerClass.Kind = ""
+	offerClass.Review = nil
+	offerClass.Version = 0
+	offerClass.ReviewStatus = string(ReviewUnderReview)
+
+	start = time.Now()
+	res, err := d.svc().Offerclass.Insert(offerClass).Do()
+	d.observe("offerclass.insert", start, err)
+	if err != nil {
+		return nil, fmt.Errorf("unable to insert class %s: %w", dstId, wrapAPIError(err, nil, ErrClassExists))
+	}
+	return res, nil
 }
 
-// [END batch]
+// [END cloneClass]
+
+// [START addTranslation]
+// Add a translation of the class title.
+//
+// Patching a LocalizedString replaces it entirely, including its
+// translatedValues array and default value. To add a single translation,
+// the current class is read and the translation merged into its title
+// before the title is patched back. Only the title is sent, so the rest of
+// the class, including its review status, is left as it is. An existing
+// translation for the same language is replaced.
+func (d *demoOffer) addTranslation(issuerId, classSuffix, language, value string) error {
+	id, err := classId(issuerId, classSuffix)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	offerClass, err := d.svc().Offerclass.Get(id).Do()
+	d.observe("offerclass.get", start, err)
+	if err != nil {
+		return fmt.Errorf("unable to get class %s: %w", id, wrapAPIError(err, ErrClassNotFound, nil))
+	}
+
+	if offerClass.LocalizedTitle == nil {
+		// Keep the plain title as the default value
+		offerClass.LocalizedTitle = &walletobjects.LocalizedString{
+			DefaultValue: &walletobjects.TranslatedString{
+				Language: "en-us",
+				Value:    offerClass.Title,
+			},
+		}
+	}
+	title := offerClass.LocalizedTitle
+	found := false
+	for _, translation := range title.TranslatedValues {
+		if strings.EqualFold(translation.Language, language) {
+			translation.Value = value
+			found = true
+		}
+	}
+	if !found {
+		title.TranslatedValues = append(title.TranslatedValues, &walletobjects.TranslatedString{
+			Language: language,
+			Value:    value,
+		})
+	}
+
+	start = time.Now()
+	_, err = d.svc().Offerclass.Patch(id, &walletobjects.OfferClass{
+		LocalizedTitle: title,
+	}).Do()
+	d.observe("offerclass.patch", start, err)
+	if err != nil {
+		return fmt.Errorf("unable to patch class %s: %w", id, wrapAPIError(err, ErrClassNotFound, nil))
+	}
+	return nil
+}
+
+// [END addTranslation]
+
+// [START classMessages]
+// Add a message to a class. The message is shown on every object of the
+// class, after any existing messages.
+//
+// If notify is true, the message is sent as TEXT_AND_NOTIFY and every user
+// who has saved an object of the class gets a push notification, which for
+// a popular class can be millions of users. Otherwise the message is added
+// silently as TEXT, whatever the messageType of message.
+func (d *demoOffer) addClassMessage(issuerId, classSuffix string, message *walletobjects.Message, notify bool) error {
+	id, err := classId(issuerId, classSuffix)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	_, err = d.svc().Offerclass.Addmessage(id, &walletobjects.AddMessageRequest{
+		Message: withMessageType(message, notify),
+	}).Do()
+	d.observe("offerclass.addmessage", start, err)
+	if err != nil {
+		return fmt.Errorf("unable to add message to class %s: %w", id, wrapAPIError(err, ErrClassNotFound, nil))
+	}
+	return nil
+}
+
+// Copy a message, with its messageType set to TEXT_AND_NOTIFY if notify is
+// true and to TEXT otherwise.
+func withMessageType(message *walletobjects.Message, notify bool) *walletobjects.Message {
+	m := *message
+	m.MessageType = "TEXT"
+	if notify {
+		// Not yet listed in the client library's MessageType values
+		m.MessageType = "TEXT_AND_NOTIFY"
+	}
+	return &m
+}
+
+// List the messages on a class. A class without messages returns an
+// empty slice.
+func (d *demoOffer) listClassMessages(issuerId, classSuffix string) ([]*walletobjects.Message, error) {
+	id, err := classId(issuerId, classSuffix)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	offerClass, err := d.svc().Offerclass.Get(id).Do()
+	d.observe("offerclass.get", start, err)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get class %s: %w", id, wrapAPIError(err, ErrClassNotFound, nil))
+	}
+	if offerClass.Messages == nil {
+		return []*walletobjects.Message{}, nil
+	}
+	return offerClass.Messages, nil
+}
+
+// Remove a message from a class by its ID.
+//
+// The messages array can't be edited in place, so the class is patched
+// with the remaining messages.
+func (d *demoOffer) removeClassMessage(issuerId, classSuffix, messageId string) error {
+	messages, err := d.listClassMessages(issuerId, classSuffix)
+	if err != nil {
+		return err
+	}
+	remaining := []*walletobjects.Message{}
+	found := false
+	for _, message := range messages {
+		if message.Id == messageId {
+			found = true
+			continue
+		}
+		remaining = append(remaining, message)
+	}
+	if !found {
+		return fmt.Errorf("class %s.%s has no message %s", issuerId, classSuffix, messageId)
+	}
+
+	id, _ := classId(issuerId, classSuffix)
+	patch := &walletobjects.OfferClass{
+		Messages: remaining,
+		// Send an empty array when the last message is removed
+		ForceSendFields: []string{"Messages"},
+	}
+	start := time.Now()
+	_, err = d.svc().Offerclass.Patch(id, patch).Do()
+	d.observe("offerclass.patch", start, err)
+	if err != nil {
+		return fmt.Errorf("unable to patch class %s: %w", id, wrapAPIError(err, ErrClassNotFound, nil))
+	}
+	return nil
+}
+
+// [END classMessages]
+
+// [START objectMessages]
+// Add a message to a single object, e.g. to tell one user their coupon
+// has been topped up. notify works as for addClassMessage, but only the
+// holder of this object is notified.
+func (d *demoOffer) addObjectMessage(issuerId, objectSuffix, header, body string, notify bool) error {
+	if header == "" || body == "" {
+		return errors.New("message header and body must not be empty")
+	}
+	return d.addObjectMessageWith(issuerId, objectSuffix, &walletobjects.Message{
+		Header: header,
+		Body:   body,
+	}, notify)
+}
+
+// Add a message with a translated header and body to a single object, so
+// it's shown in the user's language.
+//
+// Both must have a default value, which is shown in any language without
+// a translation. It's also sent as the plain header and body.
+func (d *demoOffer) addLocalizedObjectMessage(issuerId, objectSuffix string, header, body *walletobjects.LocalizedString, notify bool) error {
+	if header == nil || header.DefaultValue == nil || header.DefaultValue.Value == "" {
+		return errors.New("localized message header has no default value")
+	}
+	if body == nil || body.DefaultValue == nil || body.DefaultValue.Value == "" {
+		return errors.New("localized message body has no default value")
+	}
+	return d.addObjectMessageWith(issuerId, objectSuffix, &walletobjects.Message{
+		Header:          header.DefaultValue.Value,
+		Body:            body.DefaultValue.Value,
+		LocalizedHeader: header,
+		LocalizedBody:   body,
+	}, notify)
+}
+
+// Add a message to an object, setting its messageType from notify.
+func (d *demoOffer) addObjectMessageWith(issuerId, objectSuffix string, message *walletobjects.Message, notify bool) error {
+	id, err := objectId(issuerId, objectSuffix)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	_, err = d.svc().Offerobject.Addmessage(id, &walletobjects.AddMessageRequest{
+		Message: withMessageType(message, notify),
+	}).Do()
+	d.observe("offerobject.addmessage", start, err)
+	if err != nil {
+		return fmt.Errorf("unable to add message to object %s: %w", id, wrapAPIError(err, ErrObjectNotFound, nil))
+	}
+	return nil
+}
+
+// [END objectMessages]
+
+// Settings for an offer object. Unset fields are left out of the object.
+type OfferObjectConfig struct {
+	State ObjectState
+
+	// Period during which the object is valid. Classes have no validity
+	// period of their own, so this is the only one that applies: to give
+	// every object in a class the same window, set the same interval on
+	// each object.
+	ValidTimeInterval *walletobjects.TimeInterval
+
+	// Don't notify the user when the object is about to expire. Requires
+	// ValidTimeInterval to have an end date, as there is nothing to
+	// notify about otherwise.
+	DisableExpirationNotification bool
+
+	// Banner image for this object, in place of the class heroImage. Use
+	// localizedHeroImage to pick one for the user's market.
+	HeroImage *walletobjects.Image
+
+	// The barcode is only added if BarcodeValue is set. BarcodeType
+	// defaults to QR_CODE.
+	BarcodeType          BarcodeType
+	BarcodeValue         string
+	BarcodeAlternateText string
+	BarcodeShowCodeText  *walletobjects.LocalizedString
+
+	// Barcode whose value changes over time, e.g. a TOTP code. Its
+	// totpDetails apply to this object only.
+	RotatingBarcode *walletobjects.RotatingBarcode
+
+	// IDs of other objects related to this one, e.g. the loyalty card an
+	// offer is redeemed with. Linked objects appear together in the
+	// user's wallet.
+	LinkedObjectIds []string
+
+	// Class settings to embed in the object as its classReference. The
+	// API resolves the class from classId, and fills in classReference
+	// when the object is read, so this is only needed when the object is
+	// rendered without its class being fetched, e.g. in a preview or test
+	// that shows the object before the class is inserted. classId still
+	// decides which class the object belongs to.
+	ClassReference *OfferClassConfig
+
+	// Fields to add to the object's JSON, for API fields the client
+	// library doesn't have yet. They replace fields of the same name.
+	ExtraFields map[string]any
+
+	Locations        []*walletobjects.LatLongPoint
+	LinksModuleData  *walletobjects.LinksModuleData
+	ImageModulesData []*walletobjects.ImageModuleData
+	TextModulesData  []*walletobjects.TextModuleData
+}
+
+// The object settings used throughout the demo.
+func demoOfferObjectConfig() *OfferObjectConfig {
+	return &OfferObjectConfig{
+		State: StateActive,
+		ValidTimeInterval: &walletobjects.TimeInterval{
+			Start: &walletobjects.DateTime{
+				Date: "2023-06-12T23:20:50.52Z",
+			},
+			End: &walletobjects.DateTime{
+				Date: "2023-12-12T23:20:50.52Z",
+			},
+		},
+		HeroImage:    newImage("https://farm4.staticflickr.com/3723/11177041115_6e6a3b6f49_o.jpg", ""),
+		BarcodeType:  BarcodeQrCode,
+		BarcodeValue: "QR code",
+		BarcodeShowCodeText: &walletobjects.LocalizedString{
+			DefaultValue: &walletobjects.TranslatedString{
+				Language: "en-us",
+				Value:    "Show this code at checkout",
+			},
+			TranslatedValues: []*walletobjects.TranslatedString{
+				&walletobjects.TranslatedString{
+					Language: "es",
+					Value:    "Muestra este código al pagar",
+				},
+			},
+		},
+		Locations: []*walletobjects.LatLongPoint{
+			&walletobjects.LatLongPoint{
+				Latitude:  37.424015499999996,
+				Longitude: -122.09259560000001,
+			},
+		},
+		LinksModuleData: &walletobjects.LinksModuleData{
+			Uris: []*walletobjects.Uri{
+				newLinkUri("LINK_MODULE_URI_ID", "http://maps.google.com/", "Link module URI description", &walletobjects.LocalizedString{
+					DefaultValue: &walletobjects.TranslatedString{
+						Language: "en-us",
+						Value:    "Link module URI description",
+					},
+					TranslatedValues: []*walletobjects.TranslatedString{
+						&walletobjects.TranslatedString{
+							Language: "es",
+							Value:    "Descripción del enlace",
+						},
+					},
+				}),
+				newLinkUri("LINK_MODULE_TEL_ID", "tel:6505555555", "Link module tel description", nil),
+			},
+		},
+		ImageModulesData: []*walletobjects.ImageModuleData{
+			&walletobjects.ImageModuleData{
+				Id: "IMAGE_MODULE_ID",
+				MainImage: &walletobjects.Image{
+					SourceUri: &walletobjects.ImageUri{
+						Uri: "http://farm4.staticflickr.com/3738/12440799783_3dc3c20606_b.jpg",
+					},
+				},
+			},
+		},
+		TextModulesData: []*walletobjects.TextModuleData{
+			&walletobjects.TextModuleData{
+				Body:   "Text module body",
+				Header: "Text module header",
+				Id:     "TEXT_MODULE_ID",
+			},
+		},
+	}
+}
+
+// Build the object described by the config.
+func (c *OfferObjectConfig) offerObject(id, classId string) (*walletobjects.OfferObject, error) {
+	offerObject := &walletobjects.OfferObject{
+		Id:                id,
+		ClassId:           classId,
+		State:             string(c.State),
+		ValidTimeInterval: c.ValidTimeInterval,
+		HeroImage:         c.HeroImage,
+		Locations:         c.Locations,
+		LinksModuleData:   c.LinksModuleData,
+		ImageModulesData:  c.ImageModulesData,
+		TextModulesData:   c.TextModulesData,
+	}
+	if err := c.State.Validate(); err != nil {
+		return nil, err
+	}
+	if c.DisableExpirationNotification {
+		if c.ValidTimeInterval == nil || c.ValidTimeInterval.End == nil {
+			return nil, errors.New("disableExpirationNotification needs validTimeInterval to have an end date")
+		}
+		offerObject.DisableExpirationNotification = true
+	}
+	if c.BarcodeValue != "" {
+		barcodeType := c.BarcodeType
+		if barcodeType == "" {
+			barcodeType = BarcodeQrCode
+		}
+		barcode, err := newBarcode(barcodeType, c.BarcodeValue, c.BarcodeAlternateText, c.BarcodeShowCodeText)
+		if err != nil {
+			return nil, fmt.Errorf("invalid barcode: %w", err)
+		}
+		offerObject.Barcode = barcode
+	}
+	if c.RotatingBarcode != nil {
+		if err := validateRotatingBarcode(c.RotatingBarcode); err != nil {
+			return nil, err
+		}
+		offerObject.RotatingBarcode = c.RotatingBarcode
+	}
+	if c.ClassReference != nil {
+		offerClass, err := c.ClassReference.offerClass(classId)
+		if err != nil {
+			return nil, fmt.Errorf("invalid class reference: %w", err)
+		}
+		// The review status only applies to the class itself
+		offerClass.ReviewStatus = ""
+		offerObject.ClassReference = offerClass
+	}
+	return offerObject, nil
+}
+
+// [START createObject]
+// Create an object from config. If config is nil, the demo object is
+// created.
+func (d *demoOffer) createObject(issuerId, classSuffix, objectSuffix string, config *OfferObjectConfig) (*Result, error) {
+	id, err := objectId(issuerId, objectSuffix)
+	if err != nil {
+		return nil, fmt.Errorf("invalid object ID: %w", err)
+	}
+	cid, err := classId(issuerId, classSuffix)
+	if err != nil {
+		return nil, fmt.Errorf("invalid class ID: %w", err)
+	}
+	if config == nil {
+		config = demoOfferObjectConfig()
+	}
+	offerObject, err := config.offerObject(id, cid)
+	if err != nil {
+		return nil, err
+	}
+	images := []**walletobjects.Image{&offerObject.HeroImage}
+	// Copy the image modules, so the config's images aren't replaced
+	imageModules := make([]*walletobjects.ImageModuleData, len(offerObject.ImageModulesData))
+	for i, module := range offerObject.ImageModulesData {
+		module := *module
+		imageModules[i] = &module
+		images = append(images, &module.MainImage)
+	}
+	offerObject.ImageModulesData = imageModules
+	if err := d.proxyImages(images...); err != nil {
+		return nil, err
+	}
+	if d.checkImages {
+		if err := checkImage("heroImage", offerObject.HeroImage); err != nil {
+			return nil, err
+		}
+		for _, module := range offerObject.ImageModulesData {
+			if err := checkImage("mainImage", module.MainImage); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, linkedId := range config.LinkedObjectIds {
+		if err := validateObjectId(linkedId); err != nil {
+			return nil, fmt.Errorf("invalid linked object ID: %w", err)
+		}
+	}
+
+	if d.validate {
+		if err := validateOfferObject(offerObject); err != nil {
+			return nil, fmt.Errorf("invalid object: %w", err)
+		}
+	}
+	if d.requireApprovedClass {
+		status, err := d.getClassReviewStatus(context.Background(), issuerId, classSuffix)
+		if err != nil {
+			return nil, err
+		}
+		if status != ReviewApproved {
+			return nil, fmt.Errorf("class %s is %s, not %s; objects in it may not render", cid, status, ReviewApproved)
+		}
+	} else if d.requireExistingClass {
+		if err := d.checkClassExists(context.Background(), issuerId, classSuffix); err != nil {
+			return nil, err
+		}
+	}
+	extraFields := make(map[string]any)
+	for name, value := range config.ExtraFields {
+		extraFields[name] = value
+	}
+	if len(config.LinkedObjectIds) > 0 {
+		// OfferObject has no linkedObjectIds field in the client library
+		extraFields["linkedObjectIds"] = config.LinkedObjectIds
+	}
+	res, err := d.insertObjectOnce(offerObject, func() (*walletobjects.OfferObject, error) {
+		start := time.Now()
+		var res *walletobjects.OfferObject
+		var err error
+		if len(extraFields) > 0 {
+			res, err = d.insertOfferObjectJSON(context.Background(), offerObject, extraFields)
+		} else {
+			res, err = d.svc().Offerobject.Insert(offerObject).Do()
+		}
+		d.observe("offerobject.insert", start, err)
+		return res, err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to insert object: %w", wrapAPIError(err, nil, ErrObjectExists))
+	}
+	return &Result{Op: "object.insert", ID: res.Id}, nil
+}
+
+// [END createObject]
+
+// How many times a call is attempted before a transient error is
+// returned, and the delay before the first retry, which doubles after
+// each attempt.
+const maxAttempts = 3
+
+var retryDelay = time.Second
+
+// Check if an error may go away when the call is retried: a timeout, or a
+// rate limit or server error from the API.
+func isTransient(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		switch apiErr.Code {
+		case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+	}
+	return false
+}
+
+// Make an API call, retrying it with backoff while it fails with a
+// transient error.
+//
+// Only use this for idempotent calls, e.g. Get, Update or Patch, which
+// have the same effect however many times they're made. An insert that
+// times out may still have created the object, so retrying it blindly
+// could fail with a conflict, or for calls that don't take an ID, create
+// a duplicate; see insertObjectOnce.
+func retryIdempotent(call func() error) error {
+	delay := retryDelay
+	for attempt := 1; ; attempt++ {
+		err := call()
+		if err == nil || attempt == maxAttempts || !isTransient(err) {
+			return err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// Insert an object, retrying the insert on a transient error only once a
+// Get confirms the object wasn't created.
+//
+// A transient error, e.g. a 503 or a timeout, doesn't mean the insert
+// failed: the object may have been created and only the response lost.
+// If the Get finds the object, the insert is treated as a success and the
+// object returned. If the Get fails for any reason other than the object
+// not existing, the insert's error is returned, as it's unknown whether
+// the object was created.
+func (d *demoOffer) insertObjectOnce(offerObject *walletobjects.OfferObject, insert func() (*walletobjects.OfferObject, error)) (*walletobjects.OfferObject, error) {
+	delay := retryDelay
+	res, err := insert()
+	for attempt := 1; attempt < maxAttempts && isTransient(err); attempt++ {
+		time.Sleep(delay)
+		delay *= 2
+
+		start := time.Now()
+		existing, getErr := d.svc().Offerobject.Get(offerObject.Id).Do()
+		d.observe("offerobject.get", start, getErr)
+		if getErr == nil {
+			return existing, nil
+		}
+		if !errors.Is(wrapAPIError(getErr, ErrObjectNotFound, nil), ErrObjectNotFound) {
+			return nil, err
+		}
+		res, err = insert()
+	}
+	return res, err
+}
+
+// Check that a class exists, e.g. before creating objects in it.
+func (d *demoOffer) checkClassExists(ctx context.Context, issuerId, classSuffix string) error {
+	id, err := classId(issuerId, classSuffix)
+	if err != nil {
+		return err
+	}
+	err = retryIdempotent(func() error {
+		start := time.Now()
+		_, err := d.svc().Offerclass.Get(id).Fields("id").Context(ctx).Do()
+		d.observe("offerclass.get", start, err)
+		return err
+	})
+	err = wrapAPIError(err, ErrClassNotFound, nil)
+	if errors.Is(err, ErrClassNotFound) {
+		return fmt.Errorf("class %s does not exist; create it before its objects: %w", id, err)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to get class %s: %w", id, err)
+	}
+	return nil
+}
+
+// Marshal v to a JSON object, with fields added to it.
+//
+// v is marshalled as usual, so its ForceSendFields and NullFields apply.
+// Fields with the same name as one of v's are replaced.
+func mergeJSONFields(v any, fields map[string]any) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var merged map[string]any
+	if err := json.Unmarshal(b, &merged); err != nil {
+		return nil, err
+	}
+	for name, value := range fields {
+		merged[name] = value
+	}
+	return json.Marshal(merged)
+}
+
+// Insert an object, adding fields the client library doesn't know about
+// to its JSON representation.
+func (d *demoOffer) insertOfferObjectJSON(ctx context.Context, offerObject *walletobjects.OfferObject, fields map[string]any) (*walletobjects.OfferObject, error) {
+	b, err := mergeJSONFields(offerObject, fields)
+	if err != nil {
+		return nil, err
+	}
+
+	insertUrl := strings.TrimSuffix(d.svc().BasePath, "/") + "/walletobjects/v1/offerObject"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, insertUrl, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := d.httpClient(ctx).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if err := googleapi.CheckResponse(res); err != nil {
+		return nil, err
+	}
+	inserted := new(walletobjects.OfferObject)
+	if err := json.NewDecoder(res.Body).Decode(inserted); err != nil {
+		return nil, err
+	}
+	return inserted, nil
+}
+
+// [START expireObject]
+// Expire an object.
+//
+// Sets the object's state to Expired. If the valid time interval is
+// already set, the pass will expire automatically up to 24 hours after.
+//
+// If silent is true, disableExpirationNotification is set so the user
+// isn't notified that the pass expired, e.g. when a cleanup job expires
+// old passes. This only affects expiration notifications; whether class
+// messages notify users is chosen when they're added, see addClassMessage.
+func (d *demoOffer) expireObject(issuerId, objectSuffix string, silent bool) (*Result, error) {
+	id, err := objectId(issuerId, objectSuffix)
+	if err != nil {
+		return nil, fmt.Errorf("invalid object ID: %w", err)
+	}
+	offerObject := &walletobjects.OfferObject{
+		State:                         string(StateExpired),
+		DisableExpirationNotification: silent,
+	}
+	start := time.Now()
+	res, err := d.svc().Offerobject.Patch(id, offerObject).Do()
+	d.observe("offerobject.patch", start, err)
+	if err != nil {
+		return nil, fmt.Errorf("unable to patch object: %w", wrapAPIError(err, ErrObjectNotFound, nil))
+	}
+	return &Result{Op: "object.expire", ID: res.Id}, nil
+}
+
+// [END expireObject]
+
+// [START completeObject]
+// Mark an object as used, e.g. once an offer has been redeemed.
+//
+// Completed objects move to the user's list of expired passes like
+// expired ones do, but COMPLETED records that the user used the pass
+// rather than that it ran out. Use INACTIVE instead for a pass that was
+// never used and can no longer be, e.g. a revoked offer.
+func (d *demoOffer) completeObject(issuerId, objectSuffix string) (*Result, error) {
+	return d.setObjectState(issuerId, objectSuffix, StateCompleted, "object.complete")
+}
+
+// Mark an object as used, and add a message to it at the same time, e.g.
+// "Redeemed at the Main St store".
+//
+// Messages can't be tied to an object state: the API shows every message
+// whose displayInterval covers the current time, whatever the state. So
+// the message is added when the state changes instead, in the same patch,
+// and is only shown once the object is completed. The object's messages
+// are read first, as patching messages replaces the whole list. The
+// message is added silently, as for addClassMessage with notify false.
+func (d *demoOffer) completeObjectWithMessage(issuerId, objectSuffix string, message *walletobjects.Message) (*Result, error) {
+	id, err := objectId(issuerId, objectSuffix)
+	if err != nil {
+		return nil, fmt.Errorf("invalid object ID: %w", err)
+	}
+	start := time.Now()
+	offerObject, err := d.svc().Offerobject.Get(id).Fields("messages").Do()
+	d.observe("offerobject.get", start, err)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get object %s: %w", id, wrapAPIError(err, ErrObjectNotFound, nil))
+	}
+
+	start = time.Now()
+	res, err := d.svc().Offerobject.Patch(id, &walletobjects.OfferObject{
+		State:    string(StateCompleted),
+		Messages: append(offerObject.Messages, withMessageType(message, false)),
+	}).Do()
+	d.observe("offerobject.patch", start, err)
+	if err != nil {
+		return nil, fmt.Errorf("unable to patch object: %w", wrapAPIError(err, ErrObjectNotFound, nil))
+	}
+	return &Result{Op: "object.complete", ID: res.Id}, nil
+}
+
+// Patch the state of an object, reporting the result as op.
+func (d *demoOffer) setObjectState(issuerId, objectSuffix string, state ObjectState, op string) (*Result, error) {
+	if err := state.Validate(); err != nil {
+		return nil, err
+	}
+	id, err := objectId(issuerId, objectSuffix)
+	if err != nil {
+		return nil, fmt.Errorf("invalid object ID: %w", err)
+	}
+	start := time.Now()
+	res, err := d.svc().Offerobject.Patch(id, &walletobjects.OfferObject{
+		State: string(state),
+	}).Do()
+	d.observe("offerobject.patch", start, err)
+	if err != nil {
+		return nil, fmt.Errorf("unable to patch object: %w", wrapAPIError(err, ErrObjectNotFound, nil))
+	}
+	return &Result{Op: op, ID: res.Id}, nil
+}
+
+// [END completeObject]
+
+// [START batchExpire]
+// Expire objects in a single batch request. If silent is true, users
+// aren't notified that their passes expired, as for expireObject.
+//
+// The returned error is only set if the batch request itself failed.
+func (d *demoOffer) batchExpireObjects(issuerId string, suffixes []string, silent bool) ([]BatchResult, error) {
+	patch, err := json.Marshal(&walletobjects.OfferObject{
+		State:                         string(StateExpired),
+		DisableExpirationNotification: silent,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(suffixes))
+	ops := make([]batchOperation, len(suffixes))
+	for i, objectSuffix := range suffixes {
+		id, err := objectId(issuerId, objectSuffix)
+		if err != nil {
+			return nil, err
+		}
+		ids[i] = id
+		ops[i] = batchOperation{
+			method: "PATCH",
+			path:   "/walletobjects/v1/offerObject/" + url.PathEscape(id),
+			body:   patch,
+		}
+	}
+
+	responses, err := d.doBatch(context.Background(), ops, nil)
+
+	results := make([]BatchResult, len(responses))
+	for i, res := range responses {
+		results[i].ID = ids[i]
+		if res.statusCode != http.StatusOK {
+			results[i].Err = fmt.Errorf("unable to expire object %s: %w", ids[i], wrapAPIError(res.err(), ErrObjectNotFound, nil))
+		}
+	}
+	return results, err
+}
+
+// [END batchExpire]
+
+// Number of objects to ask for in each page of a list. Without a page
+// size the API returns every object of the class in one response.
+const listPageSize = 100
+
+// [START expireStaleObjects]
+// Expire every object in a class whose validity period ended before now.
+//
+// Objects without an end date never expire, and objects that are already
+// expired are skipped. The IDs of the objects expired are returned.
+//
+// An object that can't be expired doesn't stop the others from being
+// expired: the IDs of the objects that were expired are returned along
+// with an error joining the failures. Listing the objects failing does
+// stop the run, as there are no more objects to expire, as does
+// cancelling ctx.
+func (d *demoOffer) expireStaleObjects(ctx context.Context, issuerId, classSuffix string, now time.Time) ([]string, error) {
+	cid, err := classId(issuerId, classSuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	var expired []string
+	var errs []error
+	token := ""
+	for {
+		call := d.svc().Offerobject.List().ClassId(cid).MaxResults(listPageSize).Context(ctx)
+		if token != "" {
+			call.Token(token)
+		}
+		start := time.Now()
+		res, err := call.Do()
+		d.observe("offerobject.list", start, err)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unable to list objects of class %s: %w", cid, wrapAPIError(err, ErrClassNotFound, nil)))
+			return expired, errors.Join(errs...)
+		}
+
+		for _, offerObject := range res.Resources {
+			if ObjectState(offerObject.State) == StateExpired || offerObject.ValidTimeInterval == nil || offerObject.ValidTimeInterval.End == nil {
+				continue
+			}
+			end, err := parseDateTime(offerObject.ValidTimeInterval.End.Date)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("object %s: %w", offerObject.Id, err))
+				continue
+			}
+			if !end.Before(now) {
+				continue
+			}
+
+			start := time.Now()
+			_, err = d.svc().Offerobject.Patch(offerObject.Id, &walletobjects.OfferObject{
+				State: string(StateExpired),
+			}).Context(ctx).Do()
+			d.observe("offerobject.patch", start, err)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("unable to expire object %s: %w", offerObject.Id, wrapAPIError(err, ErrObjectNotFound, nil)))
+				if ctx.Err() != nil {
+					return expired, errors.Join(errs...)
+				}
+				continue
+			}
+			expired = append(expired, offerObject.Id)
+		}
+
+		if res.Pagination == nil || res.Pagination.NextPageToken == "" {
+			return expired, errors.Join(errs...)
+		}
+		token = res.Pagination.NextPageToken
+	}
+}
+
+// Parse the date of a DateTime.
+//
+// Dates are ISO 8601 date/times, with or without an offset, or plain
+// dates. A date/time without an offset is a local time at the venue; as
+// the venue's time zone isn't known here, it's treated as UTC.
+func parseDateTime(date string) (time.Time, error) {
+	for _, layout := range []string{time.RFC3339Nano, "2006-01-02T15:04:05.999999999", "2006-01-02"} {
+		if t, err := time.Parse(layout, date); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q", date)
+}
+
+// [END expireStaleObjects]
+
+// [START exportClassObjects]
+// Write every object of a class to w as newline-delimited JSON, e.g. for a
+// backup.
+//
+// Objects are listed listPageSize at a time and written as they arrive, so
+// only one page is held in memory. The number of objects written is returned.
+// A write error stops the export.
+func (d *demoOffer) exportClassObjects(ctx context.Context, issuerId, classSuffix string, w io.Writer) (int, error) {
+	cid, err := classId(issuerId, classSuffix)
+	if err != nil {
+		return 0, err
+	}
+
+	encoder := json.NewEncoder(w)
+	count := 0
+	token := ""
+	for {
+		call := d.svc().Offerobject.List().ClassId(cid).MaxResults(listPageSize).Context(ctx)
+		if token != "" {
+			call.Token(token)
+		}
+		start := time.Now()
+		res, err := call.Do()
+		d.observe("offerobject.list", start, err)
+		if err != nil {
+			return count, fmt.Errorf("unable to list objects of class %s: %w", cid, wrapAPIError(err, ErrClassNotFound, nil))
+		}
+
+		for _, offerObject := range res.Resources {
+			if err := encoder.Encode(offerObject); err != nil {
+				return count, fmt.Errorf("unable to write object %s: %w", offerObject.Id, err)
+			}
+			count++
+		}
+
+		if res.Pagination == nil || res.Pagination.NextPageToken == "" {
+			return count, nil
+		}
+		token = res.Pagination.NextPageToken
+	}
+}
+
+// [END exportClassObjects]
+
+// [START updateObjectFields]
+// Update only the named fields of an object.
+//
+// Patch sends every field of the object that holds a non-zero value,
+// because the client library omits empty fields when marshalling to JSON.
+// This means a field can't be cleared by setting it to its Go zero value
+// ("", false, 0, nil or an empty slice or map): the field is simply left
+// out of the request and the server keeps its current value. The Wallet
+// API doesn't accept an updateMask parameter, so instead the patch is
+// built from the named fields only. Named fields holding an empty value
+// are added to NullFields, which sends them as JSON null and clears them
+// on the server.
+//
+// Fields are given by their Go names, e.g. "HeroImage" or "Locations".
+func (d *demoOffer) updateObjectFields(issuerId, objectSuffix string, offerObject *walletobjects.OfferObject, fields ...string) (*walletobjects.OfferObject, error) {
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("no fields given to update")
+	}
+
+	id, err := objectId(issuerId, objectSuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	src := reflect.ValueOf(offerObject).Elem()
+	patch := new(walletobjects.OfferObject)
+	dst := reflect.ValueOf(patch).Elem()
+	for _, name := range fields {
+		switch name {
+		case "Id", "ForceSendFields", "NullFields", "ServerResponse":
+			return nil, fmt.Errorf("field %q can't be updated", name)
+		}
+		value := src.FieldByName(name)
+		if !value.IsValid() {
+			return nil, fmt.Errorf("unknown object field %q", name)
+		}
+		if isEmptyValue(value) {
+			patch.NullFields = append(patch.NullFields, name)
+		} else {
+			dst.FieldByName(name).Set(value)
+		}
+	}
+
+	start := time.Now()
+	res, err := d.svc().Offerobject.Patch(id, patch).Do()
+	d.observe("offerobject.patch", start, err)
+	if err != nil {
+		return nil, fmt.Errorf("unable to patch object: %w", wrapAPIError(err, ErrObjectNotFound, nil))
+	}
+	return res, nil
+}
+
+// [END updateObjectFields]
+
+// Report whether a field value would be left out of the JSON by omitempty:
+// its zero value, or an empty slice or map.
+func isEmptyValue(value reflect.Value) bool {
+	switch value.Kind() {
+	case reflect.Slice, reflect.Map:
+		return value.Len() == 0
+	}
+	return value.IsZero()
+}
+
+// [START updateAppLink]
+// Update the links from an object to the issuer's app or website.
+//
+// Only appLinkData is sent in the patch, so the rest of the object is left
+// unchanged. Empty URIs are left out, but at least one must be given.
+// display sets the text and logo of the link, and may be nil.
+func (d *demoOffer) updateAppLink(issuerId, objectSuffix string, androidUri, iosUri, webUri string, display *AppLinkDisplay) error {
+	id, err := objectId(issuerId, objectSuffix)
+	if err != nil {
+		return err
+	}
+	appLinkData, err := newAppLinkData(androidUri, iosUri, webUri, display)
+	if err != nil {
+		return err
+	}
+
+	offerObject := &walletobjects.OfferObject{
+		AppLinkData: appLinkData,
+	}
+	start := time.Now()
+	_, err = d.svc().Offerobject.Patch(id, offerObject).Do()
+	d.observe("offerobject.patch", start, err)
+	if err != nil {
+		return fmt.Errorf("unable to patch object: %w", wrapAPIError(err, ErrObjectNotFound, nil))
+	}
+	return nil
+}
+
+// [END updateAppLink]
+
+// [START updateBarcodeValue]
+// Replace the value of an object's barcode, e.g. to reissue a revoked
+// coupon code.
+//
+// The object keeps its ID, so passes users have already saved show the new
+// code. Patching the barcode replaces it entirely, so the current barcode
+// is read first and only its value changed; its type, alternate text and
+// other settings are kept.
+func (d *demoOffer) updateBarcodeValue(issuerId, objectSuffix, newValue string) error {
+	if newValue == "" {
+		return errors.New("barcode value is empty")
+	}
+	id, err := objectId(issuerId, objectSuffix)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	offerObject, err := d.svc().Offerobject.Get(id).Do()
+	d.observe("offerobject.get", start, err)
+	if err != nil {
+		return fmt.Errorf("unable to get object %s: %w", id, wrapAPIError(err, ErrObjectNotFound, nil))
+	}
+	if offerObject.Barcode == nil {
+		return fmt.Errorf("object %s has no barcode", id)
+	}
+
+	barcode := offerObject.Barcode
+	barcode.Value = newValue
+	start = time.Now()
+	_, err = d.svc().Offerobject.Patch(id, &walletobjects.OfferObject{
+		Barcode: barcode,
+	}).Do()
+	d.observe("offerobject.patch", start, err)
+	if err != nil {
+		return fmt.Errorf("unable to patch object %s: %w", id, wrapAPIError(err, ErrObjectNotFound, nil))
+	}
+	return nil
+}
+
+// [END updateBarcodeValue]
+
+// [START updateRotatingBarcode]
+// Change the content format of an object's rotating barcode, without
+// recreating the pass.
+//
+// valuePattern is the barcode content, with placeholders that are filled
+// in on the device each time the barcode rotates: {totp_value_n} is the
+// current code from the nth parameter of totpDetails, and
+// {totp_timestamp_millis} or {totp_timestamp_seconds} the time the code
+// was generated. A pattern that uses {totp_value_n} needs totpDetails with
+// at least n+1 parameters.
+//
+// Patching the rotating barcode replaces it entirely, so the current one
+// is read first and its type and other settings kept. If totpDetails is
+// nil, the object's current ones are kept.
+func (d *demoOffer) updateRotatingBarcode(issuerId, objectSuffix, valuePattern string, totpDetails *walletobjects.RotatingBarcodeTotpDetails) error {
+	if valuePattern == "" {
+		return errors.New("value pattern is empty")
+	}
+	id, err := objectId(issuerId, objectSuffix)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	offerObject, err := d.svc().Offerobject.Get(id).Do()
+	d.observe("offerobject.get", start, err)
+	if err != nil {
+		return fmt.Errorf("unable to get object %s: %w", id, wrapAPIError(err, ErrObjectNotFound, nil))
+	}
+	if offerObject.RotatingBarcode == nil {
+		return fmt.Errorf("object %s has no rotating barcode", id)
+	}
+
+	rotatingBarcode := offerObject.RotatingBarcode
+	rotatingBarcode.ValuePattern = valuePattern
+	if totpDetails != nil {
+		rotatingBarcode.TotpDetails = totpDetails
+	}
+	if err := validateRotatingBarcode(rotatingBarcode); err != nil {
+		return fmt.Errorf("invalid rotating barcode: %w", err)
+	}
+
+	start = time.Now()
+	_, err = d.svc().Offerobject.Patch(id, &walletobjects.OfferObject{
+		RotatingBarcode: rotatingBarcode,
+	}).Do()
+	d.observe("offerobject.patch", start, err)
+	if err != nil {
+		return fmt.Errorf("unable to patch object %s: %w", id, wrapAPIError(err, ErrObjectNotFound, nil))
+	}
+	return nil
+}
+
+// [END updateRotatingBarcode]
+
+// [START getObjectWithClass]
+// Get an object together with its class, e.g. to render a preview of the
+// pass.
+//
+// If the class no longer exists, the object is still returned along with
+// an error saying so.
+func (d *demoOffer) getObjectWithClass(issuerId, objectSuffix string) (*walletobjects.OfferObject, *walletobjects.OfferClass, error) {
+	id, err := objectId(issuerId, objectSuffix)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	start := time.Now()
+	offerObject, err := d.svc().Offerobject.Get(id).Do()
+	d.observe("offerobject.get", start, err)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to get object %s: %w", id, wrapAPIError(err, ErrObjectNotFound, nil))
+	}
+
+	start = time.Now()
+	offerClass, err := d.svc().Offerclass.Get(offerObject.ClassId).Do()
+	d.observe("offerclass.get", start, err)
+	err = wrapAPIError(err, ErrClassNotFound, nil)
+	if errors.Is(err, ErrClassNotFound) {
+		return offerObject, nil, fmt.Errorf("class %s of object %s no longer exists: %w", offerObject.ClassId, id, err)
+	}
+	if err != nil {
+		return offerObject, nil, fmt.Errorf("unable to get class %s: %w", offerObject.ClassId, err)
+	}
+	return offerObject, offerClass, nil
+}
+
+// [END getObjectWithClass]
+
+// [START diffObject]
+// Compare an object with its desired state, e.g. to detect drift.
+//
+// Only the fields set in desired are compared, as the server fills in
+// fields of its own. The paths of the fields that differ are returned,
+// such as "state", "barcode.value" or "textModulesData[0].body".
+//
+// The API doesn't expose when an object was last modified: objects have no
+// modification time, their version field is deprecated, and responses have
+// no Last-Modified header. Comparing the content is the only way to tell
+// whether an object changed.
+func (d *demoOffer) diffObject(issuerId, objectSuffix string, desired *walletobjects.OfferObject) ([]string, error) {
+	id, err := objectId(issuerId, objectSuffix)
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	current, err := d.svc().Offerobject.Get(id).Do()
+	d.observe("offerobject.get", start, err)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get object %s: %w", id, wrapAPIError(err, ErrObjectNotFound, nil))
+	}
+
+	// Compare the JSON forms, so fields are named as in the API and unset
+	// fields are left out
+	var want, got map[string]any
+	for _, v := range []struct {
+		object *walletobjects.OfferObject
+		json   *map[string]any
+	}{{desired, &want}, {current, &got}} {
+		b, err := json.Marshal(v.object)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(b, v.json); err != nil {
+			return nil, err
+		}
+	}
+	delete(want, "id")
+
+	var diffs []string
+	diffJSON("", want, got, &diffs)
+	sort.Strings(diffs)
+	return diffs, nil
+}
+
+// Add the paths below path where want differs from got to diffs. Fields
+// of objects that aren't in want are ignored.
+func diffJSON(path string, want, got any, diffs *[]string) {
+	switch want := want.(type) {
+	case map[string]any:
+		got, ok := got.(map[string]any)
+		if !ok {
+			*diffs = append(*diffs, path)
+			return
+		}
+		for name, value := range want {
+			fieldPath := name
+			if path != "" {
+				fieldPath = path + "." + name
+			}
+			diffJSON(fieldPath, value, got[name], diffs)
+		}
+	case []any:
+		got, ok := got.([]any)
+		if !ok || len(got) != len(want) {
+			*diffs = append(*diffs, path)
+			return
+		}
+		for i := range want {
+			diffJSON(fmt.Sprintf("%s[%d]", path, i), want[i], got[i], diffs)
+		}
+	default:
+		if want != got {
+			*diffs = append(*diffs, path)
+		}
+	}
+}
+
+// [END diffObject]
+
+// How an app link is shown on the pass. All fields are optional.
+type AppLinkDisplay struct {
+	// Call to action, e.g. "Open in the app"
+	Title       *walletobjects.LocalizedString
+	Description *walletobjects.LocalizedString
+	AppLogo     *walletobjects.Image
+}
+
+// Build the app link data for an object.
+//
+// Targets with an empty URI are left out, but at least one must be set.
+// If display isn't nil, its text and logo are used for every target.
+func newAppLinkData(androidUri, iosUri, webUri string, display *AppLinkDisplay) (*walletobjects.AppLinkData, error) {
+	if androidUri == "" && iosUri == "" && webUri == "" {
+		return nil, fmt.Errorf("at least one app link URI must be set")
+	}
+	if display == nil {
+		display = new(AppLinkDisplay)
+	}
+	appLinkInfo := func(uri string) *walletobjects.AppLinkDataAppLinkInfo {
+		if uri == "" {
+			return nil
+		}
+		return &walletobjects.AppLinkDataAppLinkInfo{
+			AppTarget: &walletobjects.AppLinkDataAppLinkInfoAppTarget{
+				TargetUri: &walletobjects.Uri{
+					Uri: uri,
+				},
+			},
+			Title:        display.Title,
+			Description:  display.Description,
+			AppLogoImage: display.AppLogo,
+		}
+	}
+	return &walletobjects.AppLinkData{
+		AndroidAppLinkInfo: appLinkInfo(androidUri),
+		IosAppLinkInfo:     appLinkInfo(iosUri),
+		WebAppLinkInfo:     appLinkInfo(webUri),
+	}, nil
+}
+
+// [START jwtNew]
+// Generate a signed JWT that creates a new pass class and object.
+//
+// When the user opens the "Add to Google Wallet" URL and saves the pass to
+// their wallet, the pass class and object defined in the JWT are
+// created. This allows you to create multiple pass classes and objects in
+// one API call when the user saves the pass to their wallet.
+//
+// If classConfig is nil, only the object is included in the JWT and the
+// class must already exist. Otherwise the class built from classConfig is
+// included in the offerClasses array, and is created along with the object.
+//
+// If the link is longer than maxSaveUrlLength and d.shortenLongLinks is
+// set, the class and object are inserted through the API instead, and the
+// link returned only references them. The trade-off is that the object then
+// exists whether or not the user saves it.
+func (d *demoOffer) createJwtNewObjects(issuerId, classSuffix, objectSuffix string, classConfig *OfferClassConfig) (*Result, error) {
+	offerObject := new(walletobjects.OfferObject)
+	id, err := objectId(issuerId, objectSuffix)
+	if err != nil {
+		return nil, fmt.Errorf("invalid object ID: %w", err)
+	}
+	offerObject.Id = id
+	offerObject.ClassId, err = classId(issuerId, classSuffix)
+	if err != nil {
+		return nil, fmt.Errorf("invalid class ID: %w", err)
+	}
+	offerObject.State = string(StateActive)
+
+	builder := new(SaveRequestBuilder).AddOfferObject(offerObject)
+	var offerClass *walletobjects.OfferClass
+	if classConfig != nil {
+		offerClass, err = classConfig.offerClass(offerObject.ClassId)
+		if err != nil {
+			return nil, fmt.Errorf("invalid class: %w", err)
+		}
+		builder.AddOfferClass(offerClass)
+	}
+	payload, err := builder.Build()
+	if err != nil {
+		return nil, fmt.Errorf("unable to build JWT payload: %w", err)
+	}
+	claims := d.saveClaims(payload)
+
+	// The service account credentials are used to sign the JWT
+	token, err := d.signClaims(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	saveUrl := saveUrlPrefix + token
+	if len(saveUrl) > maxSaveUrlLength && d.shortenLongLinks {
+		saveUrl, err = d.referenceLink(offerClass, offerObject)
+		if err != nil {
+			return nil, fmt.Errorf("unable to shorten save link: %w", err)
+		}
+	}
+	return &Result{Op: "jwt.new", ID: offerObject.Id, URL: saveUrl}, nil
+}
+
+// Insert a class, if not nil, and an object through the API, and return a
+// save link that references the object by ID. A class that already exists
+// is left as it is.
+func (d *demoOffer) referenceLink(offerClass *walletobjects.OfferClass, offerObject *walletobjects.OfferObject) (string, error) {
+	if offerClass != nil {
+		start := time.Now()
+		_, err := d.svc().Offerclass.Insert(offerClass).Do()
+		d.observe("offerclass.insert", start, err)
+		err = wrapAPIError(err, nil, ErrClassExists)
+		if err != nil && !errors.Is(err, ErrClassExists) {
+			return "", fmt.Errorf("unable to insert class: %w", err)
+		}
+	}
+	start := time.Now()
+	_, err := d.svc().Offerobject.Insert(offerObject).Do()
+	d.observe("offerobject.insert", start, err)
+	if err != nil {
+		return "", fmt.Errorf("unable to insert object: %w", wrapAPIError(err, nil, ErrObjectExists))
+	}
+
+	payload, err := new(SaveRequestBuilder).AddOfferObject(&walletobjects.OfferObject{
+		Id:      offerObject.Id,
+		ClassId: offerObject.ClassId,
+	}).Build()
+	if err != nil {
+		return "", err
+	}
+	token, err := d.signClaims(d.saveClaims(payload))
+	if err != nil {
+		return "", err
+	}
+	return saveUrlPrefix + token, nil
+}
+
+// [END jwtNew]
+
+// [START jwtExisting]
+// Generate a signed JWT that references an existing pass object.
+
+// When the user opens the "Add to Google Wallet" URL and saves the pass to
+// their wallet, the pass objects defined in the JWT are added to the
+// user's Google Wallet app. This allows the user to save multiple pass
+// objects in one API call.
+func (d *demoOffer) createJwtExistingObjects(issuerId string, classSuffix string, objectSuffix string) (*Result, error) {
+	var payload map[string]interface{}
+	json.Unmarshal([]byte(fmt.Sprintf(`
+	{
+		"eventTicketObjects": [{
+			"id": "%[1]s.EVENT_OBJECT_SUFFIX",
+			"classId": "%[1]s.EVENT_CLASS_SUFFIX"
+		}],
+
+		"flightObjects": [{
+			"id": "%[1]s.FLIGHT_OBJECT_SUFFIX",
+			"classId": "%[1]s.FLIGHT_CLASS_SUFFIX"
+		}],
+
+		"genericObjects": [{
+			"id": "%[1]s.GENERIC_OBJECT_SUFFIX",
+			"classId": "%[1]s.GENERIC_CLASS_SUFFIX"
+		}],
+
+		"giftCardObjects": [{
+			"id": "%[1]s.GIFT_CARD_OBJECT_SUFFIX",
+			"classId": "%[1]s.GIFT_CARD_CLASS_SUFFIX"
+		}],
+
+		"loyaltyObjects": [{
+			"id": "%[1]s.LOYALTY_OBJECT_SUFFIX",
+			"classId": "%[1]s.LOYALTY_CLASS_SUFFIX"
+		}],
+
+		"offerObjects": [{
+			"id": "%[1]s.OFFER_OBJECT_SUFFIX",
+			"classId": "%[1]s.OFFER_CLASS_SUFFIX"
+		}],
+
+		"transitObjects": [{
+			"id": "%[1]s.TRANSIT_OBJECT_SUFFIX",
+			"classId": "%[1]s.TRANSIT_CLASS_SUFFIX"
+		}]
+	}
+	`, issuerId)), &payload)
+
+	claims := d.saveClaims(payload)
+
+	// The service account credentials are used to sign the JWT
+	token, err := d.signClaims(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Result{Op: "jwt.existing", URL: saveUrlPrefix + token}, nil
+}
+
+// [END jwtExisting]
+
+// signClaims signs save JWT claims with the service account's private key,
+// which must be an RSA key; see parseSaveSigningKey.
+func (d *demoOffer) signClaims(claims jwt.Claims) (string, error) {
+	key, err := parseSaveSigningKey(d.creds().PrivateKey)
+	if err != nil {
+		return "", err
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(key)
+	if err != nil {
+		return "", fmt.Errorf("unable to sign JWT: %w", err)
+	}
+	return token, nil
+}
+
+// signJWT signs claims for a token other than a save JWT, e.g. one your own
+// backend verifies, with RS256 or ES256 depending on the service account's
+// key; see parseSigningKey.
+func (d *demoOffer) signJWT(claims jwt.Claims) (string, error) {
+	method, key, err := parseSigningKey(d.creds().PrivateKey)
+	if err != nil {
+		return "", err
+	}
+	token, err := jwt.NewWithClaims(method, claims).SignedString(key)
+	if err != nil {
+		return "", fmt.Errorf("unable to sign JWT: %w", err)
+	}
+	return token, nil
+}
+
+// Parse the private key for signing a save JWT.
+//
+// The "Add to Google Wallet" save endpoint only accepts RS256 signatures,
+// checked against the service account's public keys, so an EC key is
+// rejected here rather than producing a save link that doesn't work.
+func parseSaveSigningKey(pemKey []byte) (*rsa.PrivateKey, error) {
+	method, key, err := parseSigningKey(pemKey)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("save JWTs must be signed with RS256, but the service account key is for %s", method.Alg())
+	}
+	return rsaKey, nil
+}
+
+// Parse a PEM encoded private key, and pick the JWT signing method for its
+// type: RS256 for an RSA key, or ES256 for a P-256 EC key. The key can be
+// PKCS #8, as in service account key files, PKCS #1 or SEC 1.
+//
+// Keys created for Google Cloud service accounts are always RSA. An EC key
+// can only be used for tokens verified by something that has its public
+// key, see signJWT; save JWTs are signed with parseSaveSigningKey.
+func parseSigningKey(pemKey []byte) (jwt.SigningMethod, any, error) {
+	block, _ := pem.Decode(pemKey)
+	if block == nil {
+		return nil, nil, errors.New("unable to parse private key: not PEM encoded")
+	}
+	var key any
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to parse private key: %w", err)
+	}
+
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return jwt.SigningMethodRS256, key, nil
+	case *ecdsa.PrivateKey:
+		if key.Curve != elliptic.P256() {
+			return nil, nil, fmt.Errorf("unsupported EC private key curve %s, ES256 needs P-256", key.Curve.Params().Name)
+		}
+		return jwt.SigningMethodES256, key, nil
+	default:
+		return nil, nil, fmt.Errorf("unsupported private key type %T, expected RSA or EC", key)
+	}
+}
+
+// [START signJwk]
+// Sign a save JWT with a service account key in JSON Web Key form, for
+// secret stores that hold keys as JWK rather than PEM. The key must belong
+// to the service account in d.credentials, as its email is the issuer.
+func (d *demoOffer) signJWTWithJWK(jwkJSON []byte, payload map[string]any) (string, error) {
+	key, err := parseRSAPrivateJWK(jwkJSON)
+	if err != nil {
+		return "", err
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodRS256, d.saveClaims(payload)).SignedString(key)
+	if err != nil {
+		return "", fmt.Errorf("unable to sign JWT: %w", err)
+	}
+	return token, nil
+}
+
+// Parse an RSA private key in JSON Web Key form (RFC 7518 section 6.3).
+func parseRSAPrivateJWK(jwkJSON []byte) (*rsa.PrivateKey, error) {
+	var jwk struct {
+		Kty string `json:"kty"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+		D   string `json:"d"`
+		P   string `json:"p"`
+		Q   string `json:"q"`
+	}
+	if err := json.Unmarshal(jwkJSON, &jwk); err != nil {
+		return nil, fmt.Errorf("unable to parse JWK: %w", err)
+	}
+	if jwk.Kty != "RSA" {
+		return nil, fmt.Errorf("JWK has key type %q, expected RSA", jwk.Kty)
+	}
+
+	// Each member is a big-endian integer, base64url encoded without padding
+	values := make(map[string]*big.Int)
+	for name, value := range map[string]string{"n": jwk.N, "e": jwk.E, "d": jwk.D, "p": jwk.P, "q": jwk.Q} {
+		if value == "" {
+			return nil, fmt.Errorf("JWK is missing the %q member, is it a private key?", name)
+		}
+		b, err := base64.RawURLEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("JWK member %q is not base64url: %w", name, err)
+		}
+		values[name] = new(big.Int).SetBytes(b)
+	}
+	if !values["e"].IsInt64() || values["e"].Int64() > math.MaxInt32 {
+		return nil, errors.New("JWK public exponent is too large")
+	}
+
+	key := &rsa.PrivateKey{
+		PublicKey: rsa.PublicKey{
+			N: values["n"],
+			E: int(values["e"].Int64()),
+		},
+		D:      values["d"],
+		Primes: []*big.Int{values["p"], values["q"]},
+	}
+	if err := key.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid JWK: %w", err)
+	}
+	key.Precompute()
+	return key, nil
+}
+
+// [END signJwk]
+
+// [START parseCallback]
+// Contents of a save or delete callback.
+type CallbackData struct {
+	ClassID  string `json:"classId"`
+	ObjectID string `json:"objectId"`
+	// "save" or "del"
+	EventType string `json:"eventType"`
+	// When the callback expires, in milliseconds since the Unix epoch
+	ExpTimeMillis int64 `json:"expTimeMillis"`
+}
+
+// The claims of a callback token.
+type callbackClaims struct {
+	CallbackData
+}
+
+// Check that the callback hasn't expired. The standard exp claim isn't
+// used, as callbacks carry expTimeMillis instead.
+func (c *callbackClaims) Valid() error {
+	if c.ExpTimeMillis != 0 && time.Now().UnixMilli() > c.ExpTimeMillis {
+		return fmt.Errorf("callback expired at %s", time.UnixMilli(c.ExpTimeMillis).UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// Verify and decode a signed callback, sent when a user saves or deletes
+// an object of a class with callbackOptions set.
+//
+// The token must be signed with RS256 by publicKey's private key; tokens
+// signed with any other algorithm are rejected. Unlike signJWT, which also
+// signs with ES256, only RSA keys are accepted, as Google signs callbacks
+// with RSA keys. Callbacks delivered in the
+// ECv2SigningOnly envelope need to be verified with Tink's
+// PaymentMethodTokenRecipient instead.
+func ParseCallbackJWT(token string, publicKey *rsa.PublicKey) (*CallbackData, error) {
+	claims := new(callbackClaims)
+	_, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (any, error) {
+		if t.Method != jwt.SigningMethodRS256 {
+			return nil, fmt.Errorf("unexpected signing method %s", t.Method.Alg())
+		}
+		return publicKey, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid callback: %w", err)
+	}
+	if claims.ClassID == "" || claims.ObjectID == "" || claims.EventType == "" {
+		return nil, errors.New("callback is missing classId, objectId or eventType")
+	}
+	return &claims.CallbackData, nil
+}
+
+// [END parseCallback]
+
+// [START createObjectAndLink]
+// Create the demo object and return a link that saves it to Google Wallet.
+//
+// The object is inserted through the API first, so the JWT only needs to
+// reference it by ID.
+func (d *demoOffer) createObjectAndLink(issuerId, classSuffix, objectSuffix string) (string, error) {
+	res, err := d.createObject(issuerId, classSuffix, objectSuffix, nil)
+	if err != nil {
+		return "", err
+	}
+	cid, err := classId(issuerId, classSuffix)
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := new(SaveRequestBuilder).AddOfferObject(&walletobjects.OfferObject{
+		Id:      res.ID,
+		ClassId: cid,
+	}).Build()
+	if err != nil {
+		return "", fmt.Errorf("unable to build JWT payload: %w", err)
+	}
+	token, err := d.signClaims(d.saveClaims(payload))
+	if err != nil {
+		return "", err
+	}
+	return saveUrlPrefix + token, nil
+}
+
+// [END createObjectAndLink]
+
+// [START newObjectLinkExistingClass]
+// Return a link that creates obj in an existing class when the user saves
+// it.
+//
+// Unlike createJwtNewObjects, the object is given by the caller, and the
+// class isn't included in the JWT, so it must already exist. Unlike
+// createObjectAndLink, nothing is inserted until the user saves the pass.
+// obj isn't modified; its ID and class ID are set from the suffixes, and
+// its state defaults to ACTIVE. The link isn't shortened: if it's longer
+// than maxSaveUrlLength, an error wrapping ErrJWTTooLong is returned.
+func (d *demoOffer) newObjectLinkExistingClass(issuerId, classSuffix, objectSuffix string, obj *walletobjects.OfferObject) (string, error) {
+	if obj == nil {
+		return "", errors.New("object is required")
+	}
+	id, err := objectId(issuerId, objectSuffix)
+	if err != nil {
+		return "", fmt.Errorf("invalid object ID: %w", err)
+	}
+	cid, err := classId(issuerId, classSuffix)
+	if err != nil {
+		return "", fmt.Errorf("invalid class ID: %w", err)
+	}
+	offerObject := *obj
+	offerObject.Id = id
+	offerObject.ClassId = cid
+	if offerObject.State == "" {
+		offerObject.State = string(StateActive)
+	}
+	if d.validate {
+		if err := validateOfferObject(&offerObject); err != nil {
+			return "", fmt.Errorf("invalid object: %w", err)
+		}
+	}
+
+	payload, err := new(SaveRequestBuilder).AddOfferObject(&offerObject).Build()
+	if err != nil {
+		return "", fmt.Errorf("unable to build JWT payload: %w", err)
+	}
+	token, err := d.signClaims(d.saveClaims(payload))
+	if err != nil {
+		return "", err
+	}
+	saveUrl := saveUrlPrefix + token
+	if len(saveUrl) > maxSaveUrlLength {
+		return "", fmt.Errorf("%w: save URL is %d characters long, over the limit of %d", ErrJWTTooLong, len(saveUrl), maxSaveUrlLength)
+	}
+	return saveUrl, nil
+}
+
+// [END newObjectLinkExistingClass]
+
+// SaveRequestBuilder builds the payload of an "Add to Google Wallet" JWT.
+//
+// Classes and objects of different pass types can be combined in a single
+// payload, for example a loyalty card together with a welcome offer:
+//
+//	payload, err := new(SaveRequestBuilder).
+//		AddLoyaltyObject(loyaltyObject).
+//		AddOfferObject(offerObject).
+//		Build()
+type SaveRequestBuilder struct {
+	// Classes and objects to include, keyed by payload array name
+	entries map[string][]any
+	// Class IDs referenced by the entries, to check they share an issuer
+	classIds []string
+}
+
+func (b *SaveRequestBuilder) add(key, classId string, entry any) *SaveRequestBuilder {
+	if b.entries == nil {
+		b.entries = make(map[string][]any)
+	}
+	b.entries[key] = append(b.entries[key], entry)
+	b.classIds = append(b.classIds, classId)
+	return b
+}
+
+// Add an offer class to create when the pass is saved.
+func (b *SaveRequestBuilder) AddOfferClass(offerClass *walletobjects.OfferClass) *SaveRequestBuilder {
+	return b.add("offerClasses", offerClass.Id, offerClass)
+}
+
+// Add an offer object to save.
+func (b *SaveRequestBuilder) AddOfferObject(offerObject *walletobjects.OfferObject) *SaveRequestBuilder {
+	return b.add("offerObjects", offerObject.ClassId, offerObject)
+}
+
+// Add a loyalty class to create when the pass is saved.
+func (b *SaveRequestBuilder) AddLoyaltyClass(loyaltyClass *walletobjects.LoyaltyClass) *SaveRequestBuilder {
+	return b.add("loyaltyClasses", loyaltyClass.Id, loyaltyClass)
+}
+
+// Add a loyalty object to save.
+func (b *SaveRequestBuilder) AddLoyaltyObject(loyaltyObject *walletobjects.LoyaltyObject) *SaveRequestBuilder {
+	return b.add("loyaltyObjects", loyaltyObject.ClassId, loyaltyObject)
+}
+
+// Build the JWT payload.
+//
+// All classes referenced by the payload must belong to the same issuer, as
+// a JWT is signed on behalf of a single issuer.
+func (b *SaveRequestBuilder) Build() (map[string]any, error) {
+	if len(b.entries) == 0 {
+		return nil, fmt.Errorf("no classes or objects added")
+	}
+	issuerId := ""
+	for _, id := range b.classIds {
+		parsed, err := ParseID(id)
+		if err != nil {
+			return nil, fmt.Errorf("invalid class ID: %w", err)
+		}
+		if issuerId == "" {
+			issuerId = parsed.IssuerID
+		} else if parsed.IssuerID != issuerId {
+			return nil, fmt.Errorf("class %s doesn't belong to issuer %s", id, issuerId)
+		}
+	}
+
+	// Round trip through JSON so the payload only holds plain values
+	entriesJson, err := json.Marshal(b.entries)
+	if err != nil {
+		return nil, fmt.Errorf("unable to marshal JWT payload: %w", err)
+	}
+	var payload map[string]any
+	if err := json.Unmarshal(entriesJson, &payload); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal JWT payload: %w", err)
+	}
+	return payload, nil
+}
+
+// Build the claims for a signed "Add to Google Wallet" JWT.
+//
+// If jwtTtl is set, the iat and exp claims are added. Google Wallet rejects
+// a save JWT after its exp time, so the link stops working once the TTL
+// has passed; links need to be generated again for users who open them
+// later.
+func (d *demoOffer) saveClaims(payload map[string]any) jwt.MapClaims {
+	claims := newSaveClaims(d.creds().Email, []string{"www.example.com"}, payload)
+	if d.jwtTtl > 0 {
+		now := d.clock()
+		claims["iat"] = now.Unix()
+		claims["exp"] = now.Add(d.jwtTtl).Unix()
+	}
+	return claims
+}
+
+// The current time from d.now, or time.Now if it isn't set.
+func (d *demoOffer) clock() time.Time {
+	if d.now != nil {
+		return d.now()
+	}
+	return time.Now()
+}
+
+func newSaveClaims(issuer string, origins []string, payload map[string]any) jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":     issuer,
+		"aud":     "google",
+		"origins": origins,
+		"typ":     "savetowallet",
+		"payload": payload,
+	}
+}
+
+// [START buildSaveJwt]
+// Sign a save JWT using a service account key file, without an API client.
+//
+// This is for integrations that only issue "Add to Google Wallet" links
+// and never call the API: the payload must then define the classes and
+// objects in full. origins lists the domains the save button may be shown
+// on.
+func BuildSaveJWT(credsJSON []byte, payload map[string]any, origins []string) (string, error) {
+	if err := checkServiceAccountType(credsJSON); err != nil {
+		return "", err
+	}
+	credentials, err := google.JWTConfigFromJSON(credsJSON, walletobjects.WalletObjectIssuerScope)
+	if err != nil {
+		return "", fmt.Errorf("unable to load credentials: %w", err)
+	}
+	if err := validateServiceAccount(credentials); err != nil {
+		return "", err
+	}
+	key, err := parseSaveSigningKey(credentials.PrivateKey)
+	if err != nil {
+		return "", err
+	}
+	claims := newSaveClaims(credentials.Email, origins, payload)
+	token, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(key)
+	if err != nil {
+		return "", fmt.Errorf("unable to sign JWT: %w", err)
+	}
+	return token, nil
+}
+
+// [END buildSaveJwt]
+
+// URLs longer than this are truncated or rejected by some browsers and
+// servers, so save links should be kept below it.
+const maxSaveUrlLength = 2000
+
+// Save links are the signed JWT appended to this URL.
+const saveUrlPrefix = "https://pay.google.com/gp/v/save/"
+
+// IsGoogleSaveURL reports whether u is a Google Wallet save link, i.e.
+// saveUrlPrefix followed by a token. It's a guard against save links
+// built from the wrong base URL, e.g. one copied from another wallet's
+// documentation; it doesn't check the token.
+func IsGoogleSaveURL(u string) bool {
+	parsed, err := url.Parse(u)
+	if err != nil || parsed.Scheme != "https" || parsed.Host != "pay.google.com" || parsed.User != nil {
+		return false
+	}
+	token, ok := strings.CutPrefix(parsed.Path, "/gp/v/save/")
+	return ok && token != "" && !strings.Contains(token, "/")
+}
+
+// [START estimateJwtSize]
+// Estimate the length of a signed save JWT, without signing it.
+//
+// The header and claims are encoded exactly as they would be for signing,
+// and the signature is the size of the service account's RSA key. If the
+// resulting "Add to Google Wallet" URL would be longer than
+// maxSaveUrlLength, the size is returned along with an error. Large
+// payloads can instead be saved by inserting the objects through the API
+// and referencing them by ID in the JWT.
+func (d *demoOffer) estimateJWTSize(payload map[string]any) (int, error) {
+	key, err := parseSaveSigningKey(d.creds().PrivateKey)
+	if err != nil {
+		return 0, err
+	}
+	signatureSize := key.Size()
+	headerJson, err := json.Marshal(jwt.New(jwt.SigningMethodRS256).Header)
+	if err != nil {
+		return 0, fmt.Errorf("unable to marshal JWT header: %w", err)
+	}
+	claimsJson, err := json.Marshal(d.saveClaims(payload))
+	if err != nil {
+		return 0, fmt.Errorf("unable to marshal JWT claims: %w", err)
+	}
+
+	// header.claims.signature, each base64url encoded without padding
+	encoding := base64.RawURLEncoding
+	size := encoding.EncodedLen(len(headerJson)) + 1 +
+		encoding.EncodedLen(len(claimsJson)) + 1 +
+		encoding.EncodedLen(signatureSize)
+
+	urlLength := len(saveUrlPrefix) + size
+	if urlLength > maxSaveUrlLength {
+		return size, fmt.Errorf("%w: save URL would be %d characters long, over the limit of %d", ErrJWTTooLong, urlLength, maxSaveUrlLength)
+	}
+	return size, nil
+}
+
+// [END estimateJwtSize]
+
+// [START saveLinkHtml]
+// Endpoint that accepts a save JWT posted from a form, for JWTs too long
+// to fit in a save link.
+const saveFormUrl = "https://pay.google.com/gp/v/save"
+
+var saveFormTemplate = template.Must(template.New("save").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Add to Google Wallet</title></head>
+<body>
+<form id="save" method="POST" action="{{.Action}}">
+<input type="hidden" name="jwt" value="{{.Token}}">
+<noscript><button type="submit">Add to Google Wallet</button></noscript>
+</form>
+<script>document.getElementById("save").submit();</script>
+</body>
+</html>
+`))
+
+// Build an HTML page that saves the payload to Google Wallet.
+//
+// The signed JWT is posted to the save endpoint by a hidden form that is
+// submitted as soon as the page loads, so there is no limit on its length
+// as there is for save links. Browsers without JavaScript show a button
+// instead. The token is HTML escaped.
+func (d *demoOffer) saveLinkHTML(payload map[string]any) (string, error) {
+	token, err := d.signClaims(d.saveClaims(payload))
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	err = saveFormTemplate.Execute(&b, struct{ Action, Token string }{saveFormUrl, token})
+	if err != nil {
+		return "", fmt.Errorf("unable to render save page: %w", err)
+	}
+	return b.String(), nil
+}
+
+// [END saveLinkHtml]
+
+// [START saveButton]
+// Base URL of the "Add to Google Wallet" button images. Download the
+// buttons from the brand guidelines at
+// https://developers.google.com/wallet/generic/resources/brand-guidelines
+// and serve them from your own site, under their file names.
+var saveButtonImageUrl = "/images/wallet"
+
+// File names of the button images for the locales they're available in.
+// Other locales use the closest match, or the US English button.
+var saveButtonImages = map[string]string{
+	"en-US": "enUS_add_to_google_wallet_add-wallet-badge.svg",
+	"en-GB": "enGB_add_to_google_wallet_add-wallet-badge.svg",
+	"de":    "de_add_to_google_wallet_add-wallet-badge.svg",
+	"es":    "es_add_to_google_wallet_add-wallet-badge.svg",
+	"fr":    "frFR_add_to_google_wallet_add-wallet-badge.svg",
+	"it":    "it_add_to_google_wallet_add-wallet-badge.svg",
+	"ja":    "jp_add_to_google_wallet_add-wallet-badge.svg",
+	"pt-BR": "br_add_to_google_wallet_add-wallet-badge.svg",
+}
+
+var saveButtonTemplate = template.Must(template.New("button").Parse(
+	`<a href="{{.Href}}" target="_blank" rel="noopener"><img src="{{.Src}}" alt="{{.Alt}}" height="48"></a>`))
+
+// SaveButton returns the HTML of an "Add to Google Wallet" button that
+// opens saveURL, with the button image for locale, e.g. "fr-CA".
+//
+// saveURL must be a save link, e.g. from createJwtNewObjects. The URL and
+// attributes are HTML escaped.
+func SaveButton(saveURL, locale string) (string, error) {
+	if !IsGoogleSaveURL(saveURL) {
+		return "", fmt.Errorf("%q is not a Google Wallet save link", saveURL)
+	}
+	image := matchLocale(locale, saveButtonImages["en-US"], saveButtonImages)
+	var b strings.Builder
+	err := saveButtonTemplate.Execute(&b, struct{ Href, Src, Alt string }{
+		Href: saveURL,
+		Src:  strings.TrimSuffix(saveButtonImageUrl, "/") + "/" + image,
+		Alt:  "Add to Google Wallet",
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to render save button: %w", err)
+	}
+	return b.String(), nil
+}
+
+// [END saveButton]
+
+// [START batch]
+// Batch create Google Wallet objects from an existing class.
+//
+// The batch request can succeed as a whole while some of the objects in it
+// fail to insert. The IDs of the objects that were created are returned
+// along with an error joining the failures of the others.
+func (d *demoOffer) batchCreateObjects(issuerId, classSuffix string) ([]string, error) {
+	var offerObjects []*walletobjects.OfferObject
+	for i := 0; i < 3; i++ {
+		objectSuffix := strings.ReplaceAll(uuid.New().String(), "-", "_")
+
+		offerObject := new(walletobjects.OfferObject)
+		id, err := objectId(issuerId, objectSuffix)
+		if err != nil {
+			return nil, err
+		}
+		offerObject.Id = id
+		offerObject.ClassId, err = classId(issuerId, classSuffix)
+		if err != nil {
+			return nil, err
+		}
+		offerObject.State = string(StateActive)
+
+		offerObjects = append(offerObjects, offerObject)
+	}
+	return d.batchCreateObjectsAcrossClasses(issuerId, offerObjects)
+}
+
+// Batch create Google Wallet objects that can each be in a different
+// class, e.g. to import a mix of passes in one request.
+//
+// Each object must have its ID and class ID set, both for issuerId: a
+// batch request is made with one issuer's credentials, so it can't create
+// objects for other issuers. Results are reported as for
+// batchCreateObjects.
+func (d *demoOffer) batchCreateObjectsAcrossClasses(issuerId string, offerObjects []*walletobjects.OfferObject) ([]string, error) {
+	if len(offerObjects) == 0 {
+		return nil, errors.New("no objects to create")
+	}
+	for _, offerObject := range offerObjects {
+		for _, id := range []string{offerObject.Id, offerObject.ClassId} {
+			parsed, err := ParseID(id)
+			if err != nil {
+				return nil, fmt.Errorf("object %q: %w", offerObject.Id, err)
+			}
+			if parsed.IssuerID != issuerId {
+				return nil, fmt.Errorf("object %s: %s belongs to issuer %s, not %s", offerObject.Id, id, parsed.IssuerID, issuerId)
+			}
+		}
+	}
+
+	// If a batch request failed, the results of the ones before it are
+	// still reported
+	results, err := d.batchInsertObjects(context.Background(), issuerId, offerObjects, nil)
+	var ids []string
+	errs := []error{err}
+	for _, result := range results {
+		if result.Err != nil {
+			errs = append(errs, result.Err)
+		} else {
+			ids = append(ids, result.ID)
+		}
+	}
+	return ids, errors.Join(errs...)
+}
+
+// [END batch]
+
+// [START batchGet]
+// Batch get Google Wallet objects.
+//
+// The returned map is keyed by object suffix. Objects that don't exist are
+// left out of the map, and reported together in the returned error; the
+// map of the objects that were found is returned either way.
+func (d *demoOffer) batchGetObjects(issuerId string, suffixes []string) (map[string]*walletobjects.OfferObject, error) {
+	objects, missing, err := d.batchGet(issuerId, suffixes)
+	if len(missing) > 0 {
+		err = errors.Join(err, fmt.Errorf("objects not found: %s", strings.Join(missing, ", ")))
+	}
+	return objects, err
+}
+
+// [END batchGet]
+
+// Get objects in a single batch request, returning the objects that were
+// found keyed by suffix, and the suffixes of the objects that don't exist.
+func (d *demoOffer) batchGet(issuerId string, suffixes []string) (map[string]*walletobjects.OfferObject, []string, error) {
+	ops := make([]batchOperation, len(suffixes))
+	for i, objectSuffix := range suffixes {
+		id, err := objectId(issuerId, objectSuffix)
+		if err != nil {
+			return nil, nil, err
+		}
+		ops[i] = batchOperation{
+			method: "GET",
+			path:   "/walletobjects/v1/offerObject/" + url.PathEscape(id),
+		}
+	}
+
+	responses, err := d.doBatch(context.Background(), ops, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	objects := make(map[string]*walletobjects.OfferObject)
+	var missing []string
+	var errs []error
+	for i, res := range responses {
+		objectSuffix := suffixes[i]
+		switch {
+		case res.statusCode == http.StatusNotFound:
+			missing = append(missing, objectSuffix)
+		case res.statusCode != http.StatusOK:
+			errs = append(errs, fmt.Errorf("unable to get object %s: %w", objectSuffix, res.err()))
+		default:
+			offerObject := new(walletobjects.OfferObject)
+			if err := json.Unmarshal(res.body, offerObject); err != nil {
+				errs = append(errs, fmt.Errorf("unable to parse object %s: %w", objectSuffix, err))
+				continue
+			}
+			objects[objectSuffix] = offerObject
+		}
+	}
+	return objects, missing, errors.Join(errs...)
+}
+
+// Find object suffixes that would collide if inserted in a single batch,
+// so the batch can be fixed before it partially fails.
+//
+// A suffix collides if it appears more than once in suffixes, or, when
+// checkExisting is set, if an object with that suffix already exists.
+// Checking for existing objects costs a batch request, so callers that
+// generate unique suffixes can skip it. Each colliding suffix is returned
+// once: those repeated in the batch first, then those that already exist.
+func (d *demoOffer) findObjectIdCollisions(issuerId string, suffixes []string, checkExisting bool) ([]string, error) {
+	var collisions []string
+	seen := make(map[string]int)
+	var unique []string
+	for _, objectSuffix := range suffixes {
+		seen[objectSuffix]++
+		switch seen[objectSuffix] {
+		case 1:
+			unique = append(unique, objectSuffix)
+		case 2:
+			collisions = append(collisions, objectSuffix)
+		}
+	}
+	if !checkExisting || len(unique) == 0 {
+		return collisions, nil
+	}
+
+	existing, _, err := d.batchGet(issuerId, unique)
+	if err != nil {
+		return nil, fmt.Errorf("unable to check for existing objects: %w", err)
+	}
+	for _, objectSuffix := range unique {
+		if _, ok := existing[objectSuffix]; ok && seen[objectSuffix] == 1 {
+			collisions = append(collisions, objectSuffix)
+		}
+	}
+	return collisions, nil
+}
+
+// [START batchPatch]
+// Patch fields of many objects in a single batch request, e.g. to give
+// every object in a campaign a new hero image.
+//
+// patches maps object suffixes to partial objects holding only the fields
+// to change. The results are in order of object suffix. The returned error
+// is only set if the batch request itself failed.
+func (d *demoOffer) batchPatch(issuerId string, patches map[string]*walletobjects.OfferObject) ([]BatchResult, error) {
+	if len(patches) == 0 {
+		return nil, errors.New("no objects to patch")
+	}
+	suffixes := make([]string, 0, len(patches))
+	for objectSuffix := range patches {
+		suffixes = append(suffixes, objectSuffix)
+	}
+	sort.Strings(suffixes)
+
+	ids := make([]string, len(suffixes))
+	ops := make([]batchOperation, len(suffixes))
+	for i, objectSuffix := range suffixes {
+		id, err := objectId(issuerId, objectSuffix)
+		if err != nil {
+			return nil, err
+		}
+		patchJson, err := json.Marshal(patches[objectSuffix])
+		if err != nil {
+			return nil, fmt.Errorf("unable to marshal patch for object %s: %w", id, err)
+		}
+		ids[i] = id
+		ops[i] = batchOperation{
+			method: "PATCH",
+			path:   "/walletobjects/v1/offerObject/" + url.PathEscape(id),
+			body:   patchJson,
+		}
+	}
+
+	responses, err := d.doBatch(context.Background(), ops, nil)
+
+	results := make([]BatchResult, len(responses))
+	for i, res := range responses {
+		results[i].ID = ids[i]
+		if res.statusCode != http.StatusOK {
+			results[i].Err = fmt.Errorf("unable to patch object %s: %w", ids[i], wrapAPIError(res.err(), ErrObjectNotFound, nil))
+		}
+	}
+	return results, err
+}
+
+// [END batchPatch]
+
+// [START batchUpdateClasses]
+// Patch fields of many classes in a single batch request, e.g. to give
+// every class a new logo when rebranding.
+//
+// patches maps class suffixes to partial classes holding only the fields
+// to change. The results are in order of class suffix. The returned error
+// is only set if the batch request itself failed, or a suffix is invalid.
+func (d *demoOffer) batchUpdateClasses(issuerId string, patches map[string]*walletobjects.OfferClass) ([]BatchResult, error) {
+	if len(patches) == 0 {
+		return nil, errors.New("no classes to patch")
+	}
+	suffixes := make([]string, 0, len(patches))
+	for classSuffix := range patches {
+		suffixes = append(suffixes, classSuffix)
+	}
+	sort.Strings(suffixes)
+
+	ids := make([]string, len(suffixes))
+	ops := make([]batchOperation, len(suffixes))
+	for i, classSuffix := range suffixes {
+		id, err := classId(issuerId, classSuffix)
+		if err != nil {
+			return nil, err
+		}
+		patchJson, err := json.Marshal(patches[classSuffix])
+		if err != nil {
+			return nil, fmt.Errorf("unable to marshal patch for class %s: %w", id, err)
+		}
+		ids[i] = id
+		ops[i] = batchOperation{
+			method: "PATCH",
+			path:   "/walletobjects/v1/offerClass/" + url.PathEscape(id),
+			body:   patchJson,
+		}
+	}
+
+	responses, err := d.doBatch(context.Background(), ops, nil)
+
+	results := make([]BatchResult, len(responses))
+	for i, res := range responses {
+		results[i].ID = ids[i]
+		if res.statusCode != http.StatusOK {
+			results[i].Err = fmt.Errorf("unable to patch class %s: %w", ids[i], wrapAPIError(res.err(), ErrClassNotFound, nil))
+		}
+	}
+	return results, err
+}
+
+// [END batchUpdateClasses]
+
+// [START importCsv]
+// Create objects from a CSV file.
+//
+// The first row must be a header naming the objectSuffix, barcodeValue and
+// state columns, in any order; other columns are ignored. Each following
+// row is an object to create in the class. Rows that can't be turned into a
+// valid object are skipped, and reported as failed results alongside the
+// results of the batch insert. Results are identified by the full object
+// ID, issuerId.objectSuffix, whether or not the row was sent. A suffix that
+// is repeated in the file, or that already exists when
+// d.checkExistingObjects is set, stops the import before anything is
+// inserted.
+//
+// Large files are inserted in several batch requests. If progress isn't
+// nil, it's called after each of them with the number of objects sent so
+// far and the total, e.g. to show a progress bar. If one of them fails, the
+// results of the rows already sent are returned along with the error; the
+// rows that have no result weren't sent.
+func (d *demoOffer) importCSV(ctx context.Context, issuerId, classSuffix string, r io.Reader, progress func(done, total int)) ([]BatchResult, error) {
+	reader := csv.NewReader(r)
+	// Row lengths are checked below, so a short row doesn't stop the import
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("CSV file is empty")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read CSV header: %w", err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		columns[strings.TrimSpace(name)] = i
+	}
+	for _, name := range []string{"objectSuffix", "barcodeValue", "state"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("CSV header is missing the %s column", name)
+		}
+	}
+
+	classRef, err := classId(issuerId, classSuffix)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []BatchResult
+	var offerObjects []*walletobjects.OfferObject
+	for row := 2; ; row++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CSV row %d: %w", row, err)
+		}
+		if len(record) != len(header) {
+			results = append(results, BatchResult{
+				Err: fmt.Errorf("row %d has %d columns, expected %d", row, len(record), len(header)),
+			})
+			continue
+		}
+
+		objectSuffix := record[columns["objectSuffix"]]
+		offerObject, err := csvObject(issuerId, objectSuffix, record[columns["barcodeValue"]], record[columns["state"]])
+		if err != nil {
+			results = append(results, BatchResult{
+				// The full ID, as for the rows that were sent
+				ID:  fmt.Sprintf("%s.%s", issuerId, objectSuffix),
+				Err: fmt.Errorf("row %d: %w", row, err),
+			})
+			continue
+		}
+		offerObject.ClassId = classRef
+		offerObjects = append(offerObjects, offerObject)
+	}
+
+	if len(offerObjects) == 0 {
+		return results, nil
+	}
+	// If a batch request fails, the rows sent before it are still reported
+	batchResults, err := d.batchInsertObjects(ctx, issuerId, offerObjects, progress)
+	return append(results, batchResults...), err
+}
+
+// [END importCsv]
+
+// Build an object from the values of a CSV row.
+func csvObject(issuerId, objectSuffix, barcodeValue, state string) (*walletobjects.OfferObject, error) {
+	id, err := objectId(issuerId, objectSuffix)
+	if err != nil {
+		return nil, err
+	}
+	barcode, err := newBarcode(BarcodeQrCode, barcodeValue, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	objectState := ObjectState(strings.ToUpper(strings.TrimSpace(state)))
+	if err := objectState.Validate(); err != nil {
+		return nil, err
+	}
+	return &walletobjects.OfferObject{
+		Id:      id,
+		State:   string(objectState),
+		Barcode: barcode,
+	}, nil
+}
+
+// BatchResult is the outcome of a single operation in a batch request.
+type BatchResult struct {
+	// ID of the class or object the operation applied to
+	ID string
+	// Error returned by the API for this operation, if any
+	Err error
+}
+
+// Insert objects of an issuer in batch requests, reporting progress as for
+// doBatch.
+//
+// Nothing is inserted if an object ID is repeated, or if
+// d.checkExistingObjects is set and an object already exists; the error
+// lists the colliding IDs. Otherwise the returned error is only set if a
+// batch request itself failed, in which case the results of the requests
+// before it are returned with it: those objects were sent, and the rest
+// weren't. Errors inserting individual objects are reported in the
+// results.
+func (d *demoOffer) batchInsertObjects(ctx context.Context, issuerId string, offerObjects []*walletobjects.OfferObject, progress func(done, total int)) ([]BatchResult, error) {
+	suffixes := make([]string, len(offerObjects))
+	for i, offerObject := range offerObjects {
+		id, err := ParseID(offerObject.Id)
+		if err != nil {
+			return nil, err
+		}
+		if id.IssuerID != issuerId {
+			return nil, fmt.Errorf("object %s doesn't belong to issuer %s", offerObject.Id, issuerId)
+		}
+		suffixes[i] = id.Suffix
+	}
+	collisions, err := d.findObjectIdCollisions(issuerId, suffixes, d.checkExistingObjects)
+	if err != nil {
+		return nil, err
+	}
+	if len(collisions) > 0 {
+		return nil, fmt.Errorf("object suffixes collide, nothing was inserted: %s", strings.Join(collisions, ", "))
+	}
+
+	ops := make([]batchOperation, len(offerObjects))
+	for i, offerObject := range offerObjects {
+		offerJson, err := json.Marshal(offerObject)
+		if err != nil {
+			return nil, fmt.Errorf("unable to marshal object %s: %w", offerObject.Id, err)
+		}
+		ops[i] = batchOperation{
+			method: "POST",
+			path:   "/walletobjects/v1/offerObject",
+			body:   offerJson,
+		}
+	}
+
+	responses, err := d.doBatch(ctx, ops, progress)
+
+	results := make([]BatchResult, len(responses))
+	for i, res := range responses {
+		results[i].ID = offerObjects[i].Id
+		if res.statusCode != http.StatusOK {
+			results[i].Err = fmt.Errorf("unable to insert object %s: %w", offerObjects[i].Id, wrapAPIError(res.err(), nil, ErrObjectExists))
+		} else {
+			// Counted like an insert made on its own; the batch request
+			// itself is observed as "batch"
+			d.metricsOrNoop().IncInsert("offerobject.insert")
+		}
+	}
+	return results, err
+}
+
+// A single API call to send in a batch request.
+type batchOperation struct {
+	method string
+	// Path of the API call, e.g. "/walletobjects/v1/offerObject"
+	path string
+	// JSON request body, if any
+	body []byte
+}
+
+// The response to a single API call in a batch request.
+type batchResponse struct {
+	statusCode int
+	body       []byte
+}
+
+// Convert a failed response to the error the client library would have
+// returned for the same call.
+func (res batchResponse) err() error {
+	apiErr := &googleapi.Error{
+		Code: res.statusCode,
+		Body: string(res.body),
+	}
+	var errorBody struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(res.body, &errorBody) == nil {
+		apiErr.Message = errorBody.Error.Message
+	}
+	return apiErr
+}
+
+// The most API calls the batch endpoint accepts in a single request.
+const maxBatchOperations = 1000
+
+// Send API calls in batch requests, splitting them into as many requests
+// as needed to stay under maxBatchOperations.
+//
+// The requests are sent one after the other. If progress isn't nil, it's
+// called after each request with the number of operations sent so far and
+// the total, from the calling goroutine, so never concurrently. If a
+// request fails, the operations in the requests before it have already
+// been applied, and their responses are returned along with the error.
+//
+// The responses are returned in the same order as the operations.
+func (d *demoOffer) doBatch(ctx context.Context, ops []batchOperation, progress func(done, total int)) ([]batchResponse, error) {
+	responses := make([]batchResponse, 0, len(ops))
+	for start := 0; start < len(ops); start += maxBatchOperations {
+		end := start + maxBatchOperations
+		if end > len(ops) {
+			end = len(ops)
+		}
+		chunk, err := d.sendBatch(ctx, ops[start:end])
+		if err != nil {
+			if start > 0 {
+				return responses, fmt.Errorf("after %d of %d operations: %w", start, len(ops), err)
+			}
+			return responses, err
+		}
+		responses = append(responses, chunk...)
+		if progress != nil {
+			progress(end, len(ops))
+		}
+	}
+	return responses, nil
+}
+
+// Send API calls in a single batch request.
+//
+// The responses are returned in the same order as the operations.
+func (d *demoOffer) sendBatch(ctx context.Context, ops []batchOperation) ([]batchResponse, error) {
+	body, contentType, err := batchRequestBody(ops)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	// Batch requests go to the same endpoint as the rest of the API
+	batchUrl := strings.TrimSuffix(d.svc().BasePath, "/") + "/batch"
+	res, err := d.httpClient(ctx).Post(batchUrl, contentType, body)
+	if err != nil {
+		d.observe("batch", start, err)
+		return nil, fmt.Errorf("unable to send batch request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(res.Body)
+		err = fmt.Errorf("batch request failed: %s: %s", res.Status, b)
+		d.observe("batch", start, err)
+		return nil, err
+	}
+	d.observe("batch", start, nil)
+	responses, err := readBatchResponse(res)
+	if err != nil {
+		return nil, err
+	}
+	if len(responses) != len(ops) {
+		return nil, fmt.Errorf("batch response has %d parts, expected %d", len(responses), len(ops))
+	}
+	return responses, nil
+}
+
+// Build the multipart/mixed body of a batch request.
+//
+// Each operation is a MIME part holding an HTTP request: a request line,
+// headers, a blank line and the JSON body, with CRLF line endings. The
+// body is returned along with its content type, which names the boundary.
+func batchRequestBody(ops []batchOperation) (*bytes.Buffer, string, error) {
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	for i, op := range ops {
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Type", "application/json")
+		header.Set("Content-ID", strconv.Itoa(i+1))
+		part, err := writer.CreatePart(header)
+		if err != nil {
+			return nil, "", err
+		}
+		fmt.Fprintf(part, "%s %s HTTP/1.1\r\n", op.method, op.path)
+		if op.body != nil {
+			fmt.Fprintf(part, "Content-Type: application/json\r\n")
+			fmt.Fprintf(part, "Content-Length: %d\r\n\r\n", len(op.body))
+			part.Write(op.body)
+		} else {
+			fmt.Fprintf(part, "\r\n")
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, "", err
+	}
+	return body, "multipart/mixed; boundary=" + writer.Boundary(), nil
+}
+
+// Split a multipart batch response into the responses to each API call.
+//
+// Each part of the response body is a complete HTTP response, including
+// the status line and headers.
+func readBatchResponse(res *http.Response) ([]batchResponse, error) {
+	_, params, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse batch response content type: %w", err)
+	}
+
+	var responses []batchResponse
+	reader := multipart.NewReader(res.Body, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to read batch response: %w", err)
+		}
+		partRes, err := http.ReadResponse(bufio.NewReader(part), nil)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse batch response part: %w", err)
+		}
+		body, err := io.ReadAll(partRes.Body)
+		partRes.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("unable to read batch response part: %w", err)
+		}
+		responses = append(responses, batchResponse{
+			statusCode: partRes.StatusCode,
+			body:       body,
+		})
+	}
+	return responses, nil
+}
+
+// State of an object.
+type ObjectState string
+
+const (
+	StateActive    ObjectState = "ACTIVE"
+	StateCompleted ObjectState = "COMPLETED"
+	StateExpired   ObjectState = "EXPIRED"
+	StateInactive  ObjectState = "INACTIVE"
+)
+
+// Check that s is a known object state.
+func (s ObjectState) Validate() error {
+	switch s {
+	case StateActive, StateCompleted, StateExpired, StateInactive:
+		return nil
+	}
+	return fmt.Errorf("invalid object state %q", string(s))
+}
+
+// Review status of a class.
+type ReviewStatus string
+
+const (
+	ReviewDraft       ReviewStatus = "DRAFT"
+	ReviewUnderReview ReviewStatus = "UNDER_REVIEW"
+	ReviewApproved    ReviewStatus = "APPROVED"
+	ReviewRejected    ReviewStatus = "REJECTED"
+)
+
+// Check that s is a known review status.
+func (s ReviewStatus) Validate() error {
+	switch s {
+	case ReviewDraft, ReviewUnderReview, ReviewApproved, ReviewRejected:
+		return nil
+	}
+	return fmt.Errorf("invalid review status %q", string(s))
+}
+
+// Type of a barcode.
+type BarcodeType string
+
+const (
+	BarcodeAztec      BarcodeType = "AZTEC"
+	BarcodeCode39     BarcodeType = "CODE_39"
+	BarcodeCode128    BarcodeType = "CODE_128"
+	BarcodeCodabar    BarcodeType = "CODABAR"
+	BarcodeDataMatrix BarcodeType = "DATA_MATRIX"
+	BarcodeEan8       BarcodeType = "EAN_8"
+	BarcodeEan13      BarcodeType = "EAN_13"
+	BarcodeItf14      BarcodeType = "ITF_14"
+	BarcodePdf417     BarcodeType = "PDF_417"
+	BarcodeQrCode     BarcodeType = "QR_CODE"
+	BarcodeUpcA       BarcodeType = "UPC_A"
+	BarcodeTextOnly   BarcodeType = "TEXT_ONLY"
+)
+
+// Check that t is a known barcode type.
+func (t BarcodeType) Validate() error {
+	switch t {
+	case BarcodeAztec, BarcodeCode39, BarcodeCode128, BarcodeCodabar, BarcodeDataMatrix, BarcodeEan8,
+		BarcodeEan13, BarcodeItf14, BarcodePdf417, BarcodeQrCode, BarcodeUpcA, BarcodeTextOnly:
+		return nil
+	}
+	return fmt.Errorf("invalid barcode type %q", string(t))
+}
+
+// Check that a class has the fields the API requires.
+//
+// All missing fields are reported in a single error.
+func validateOfferClass(offerClass *walletobjects.OfferClass) error {
+	var missing []string
+	if offerClass.Id == "" {
+		missing = append(missing, "id")
+	}
+	if offerClass.Title == "" {
+		missing = append(missing, "title")
+	}
+	if offerClass.IssuerName == "" {
+		missing = append(missing, "issuerName")
+	}
+	if offerClass.Provider == "" {
+		missing = append(missing, "provider")
+	}
+	if offerClass.RedemptionChannel == "" {
+		missing = append(missing, "redemptionChannel")
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("class %s is missing required fields: %s", offerClass.Id, strings.Join(missing, ", "))
+	}
+	if err := validateRedemptionChannel(offerClass); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Check the redemption channel of a class, and the fields that depend on
+// it.
+//
+// A temporary price reduction is applied at the till without the user
+// redeeming anything, so it must say what the reduction is and can't be
+// redeemed with smart tap.
+func validateRedemptionChannel(offerClass *walletobjects.OfferClass) error {
+	switch offerClass.RedemptionChannel {
+	case "INSTORE", "ONLINE", "BOTH":
+		return nil
+	case "TEMPORARY_PRICE_REDUCTION":
+	default:
+		return fmt.Errorf("class %s has unknown redemptionChannel %q", offerClass.Id, offerClass.RedemptionChannel)
+	}
+	if offerClass.Details == "" {
+		return fmt.Errorf("class %s is a temporary price reduction but has no details describing the reduction", offerClass.Id)
+	}
+	if offerClass.EnableSmartTap || len(offerClass.RedemptionIssuers) > 0 {
+		return fmt.Errorf("class %s is a temporary price reduction, which can't be redeemed with smart tap", offerClass.Id)
+	}
+	return nil
+}
+
+// Check the smart tap settings of a class.
+//
+// Terminals can't read a smart tap pass unless redemptionIssuers lists at
+// least one collector ID, and collector IDs are always positive.
+func validateSmartTap(offerClass *walletobjects.OfferClass) error {
+	if !offerClass.EnableSmartTap {
+		return nil
+	}
+	if len(offerClass.RedemptionIssuers) == 0 {
+		return fmt.Errorf("class %s enables smart tap but has no redemptionIssuers", offerClass.Id)
+	}
+	for _, collectorId := range offerClass.RedemptionIssuers {
+		if collectorId <= 0 {
+			return fmt.Errorf("class %s has invalid collector ID %d in redemptionIssuers", offerClass.Id, collectorId)
+		}
+	}
+	return nil
+}
+
+// Check that an object has the fields the API requires.
+//
+// All missing fields are reported in a single error.
+func validateOfferObject(offerObject *walletobjects.OfferObject) error {
+	var missing []string
+	if offerObject.Id == "" {
+		missing = append(missing, "id")
+	}
+	if offerObject.ClassId == "" {
+		missing = append(missing, "classId")
+	}
+	if offerObject.State == "" {
+		missing = append(missing, "state")
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("object %s is missing required fields: %s", offerObject.Id, strings.Join(missing, ", "))
+	}
+	return ObjectState(offerObject.State).Validate()
+}
+
+// Longest value, in bytes, that each barcode type can practically hold.
+//
+// The 2D types are limited by their largest symbol holding binary data,
+// the fixed-length types by their length including the check digit. The
+// other linear types have no limit of their own, but a longer value makes
+// a barcode too wide to scan from a phone screen. TEXT_ONLY has no limit.
+var maxBarcodeLength = map[BarcodeType]int{
+	BarcodeAztec:      1914,
+	BarcodeDataMatrix: 1556,
+	BarcodePdf417:     1108,
+	BarcodeQrCode:     2953,
+	BarcodeCode128:    80,
+	BarcodeCode39:     43,
+	BarcodeCodabar:    43,
+	BarcodeEan8:       8,
+	BarcodeEan13:      13,
+	BarcodeItf14:      14,
+	BarcodeUpcA:       12,
+}
+
+// Build a barcode.
+//
+// alternateText and showCodeText are optional, and replace the text shown
+// below the barcode (by default, the barcode value). showCodeText is a
+// LocalizedString, so the label can be translated for the user's locale.
+func newBarcode(barcodeType BarcodeType, value, alternateText string, showCodeText *walletobjects.LocalizedString) (*walletobjects.Barcode, error) {
+	if err := barcodeType.Validate(); err != nil {
+		return nil, err
+	}
+	// An empty value renders as a broken barcode rather than being rejected
+	if value == "" {
+		return nil, fmt.Errorf("%s barcode value is empty", barcodeType)
+	}
+	// So does one too long for the type, or one that can't be scanned
+	if limit, ok := maxBarcodeLength[barcodeType]; ok && len(value) > limit {
+		return nil, fmt.Errorf("%s barcode value is %d bytes long, over the limit of %d", barcodeType, len(value), limit)
+	}
+	return &walletobjects.Barcode{
+		Type:          string(barcodeType),
+		Value:         value,
+		AlternateText: alternateText,
+		ShowCodeText:  showCodeText,
+	}, nil
+}
+
+// TOTP algorithms supported for rotating barcodes.
+var totpAlgorithms = []string{"TOTP_SHA1"}
+
+// Build TOTP details for a rotating barcode. Each key is used for the
+// {totp_value_n} substitution at the same index in the value pattern, and
+// produces a valueLength digit code.
+func newTotpDetails(algorithm string, period time.Duration, valueLength int64, keys ...string) *walletobjects.RotatingBarcodeTotpDetails {
+	totpDetails := &walletobjects.RotatingBarcodeTotpDetails{
+		Algorithm:    algorithm,
+		PeriodMillis: period.Milliseconds(),
+	}
+	for _, key := range keys {
+		totpDetails.Parameters = append(totpDetails.Parameters, &walletobjects.RotatingBarcodeTotpDetailsTotpParameters{
+			Key:         key,
+			ValueLength: valueLength,
+		})
+	}
+	return totpDetails
+}
+
+// Check the settings of a rotating barcode.
+//
+// Each object can have its own totpDetails, so these are checked per
+// object rather than once for the whole class. initialRotatingBarcodeValues
+// are only supported for transit objects, so they're rejected here.
+func validateRotatingBarcode(rotatingBarcode *walletobjects.RotatingBarcode) error {
+	if totp := rotatingBarcode.TotpDetails; totp != nil {
+		supported := false
+		for _, algorithm := range totpAlgorithms {
+			if totp.Algorithm == algorithm {
+				supported = true
+			}
+		}
+		if !supported {
+			return fmt.Errorf("unsupported TOTP algorithm %q, must be one of %s", totp.Algorithm, strings.Join(totpAlgorithms, ", "))
+		}
+		if totp.PeriodMillis <= 0 {
+			return fmt.Errorf("TOTP periodMillis must be positive, got %d", totp.PeriodMillis)
+		}
+	}
+	if err := validateValuePattern(rotatingBarcode.ValuePattern, rotatingBarcode.TotpDetails); err != nil {
+		return err
+	}
+	if rotatingBarcode.InitialRotatingBarcodeValues != nil {
+		return errors.New("initialRotatingBarcodeValues are only supported for transit objects, not offers")
+	}
+	return nil
+}
+
+// Build a DateTime for t, with the offset of t's location, e.g.
+// "2023-06-12T23:59:59-07:00" for a time in America/Los_Angeles.
+//
+// Google Wallet uses the offset to place the time, so an offer that ends
+// at midnight local time should be given as a time in the local time
+// zone, e.g. time.Date(2023, 6, 13, 0, 0, 0, 0, loc), rather than in UTC.
+// A time in UTC is formatted with a "Z" suffix.
+func newDateTime(t time.Time) *walletobjects.DateTime {
+	return &walletobjects.DateTime{
+		Date: t.Format(time.RFC3339),
+	}
+}
+
+// Build a time interval from start to end, each with the offset of its
+// location. See newDateTime.
+func newTimeInterval(start, end time.Time) *walletobjects.TimeInterval {
+	return &walletobjects.TimeInterval{
+		Start: newDateTime(start),
+		End:   newDateTime(end),
+	}
+}
+
+var valuePatternPlaceholder = regexp.MustCompile(`\{([^{}]*)\}`)
+
+// Check the placeholders in a rotating barcode's value pattern. Each
+// {totp_value_n} must refer to one of the parameters of totpDetails.
+func validateValuePattern(valuePattern string, totpDetails *walletobjects.RotatingBarcodeTotpDetails) error {
+	for _, m := range valuePatternPlaceholder.FindAllStringSubmatch(valuePattern, -1) {
+		name := m[1]
+		switch {
+		case name == "totp_timestamp_millis", name == "totp_timestamp_seconds":
+		case strings.HasPrefix(name, "totp_value_"):
+			n, err := strconv.Atoi(strings.TrimPrefix(name, "totp_value_"))
+			if err != nil || n < 0 {
+				return fmt.Errorf("invalid placeholder %s in value pattern", m[0])
+			}
+			if totpDetails == nil || n >= len(totpDetails.Parameters) {
+				return fmt.Errorf("value pattern placeholder %s has no matching TOTP parameter", m[0])
+			}
+		default:
+			return fmt.Errorf("unknown placeholder %s in value pattern", m[0])
+		}
+	}
+	return nil
+}
+
+// Recommended width to height ratios of images, by field. Images of
+// other shapes are cropped to fit.
+var imageAspectRatios = map[string]float64{
+	"heroImage":      1032.0 / 336,
+	"wideTitleImage": 1280.0 / 400,
+}
+
+// Client for checkImage, with a timeout so a slow image host doesn't hold
+// up the insert.
+var imageClient = &http.Client{Timeout: 10 * time.Second}
+
+// Check that an image can be fetched, and log its dimensions.
+//
+// A HEAD request checks the link first. Then only the start of the file
+// is fetched, which is enough to read the dimensions from its header. The
+// content type is taken from the response, or detected from the file if
+// the server doesn't send one. A PNG, JPEG or GIF image with an aspect
+// ratio more than 10% off the one recommended for field is logged as a
+// warning, but isn't an error.
+func checkImage(field string, img *walletobjects.Image) error {
+	if img == nil || img.SourceUri == nil {
+		return nil
+	}
+	uri := img.SourceUri.Uri
+	res, err := imageClient.Head(uri)
+	if err != nil {
+		return fmt.Errorf("unable to fetch %s %s: %w", field, uri, err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unable to fetch %s %s: %s", field, uri, res.Status)
+	}
+
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return fmt.Errorf("unable to fetch %s %s: %w", field, uri, err)
+	}
+	req.Header.Set("Range", "bytes=0-65535")
+	res, err = imageClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to fetch %s %s: %w", field, uri, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("unable to fetch %s %s: %s", field, uri, res.Status)
+	}
+	// Servers that ignore the range send the whole file, so stop reading
+	// once there's enough for the header
+	head, err := io.ReadAll(io.LimitReader(res.Body, 65536))
+	if err != nil {
+		return fmt.Errorf("unable to fetch %s %s: %w", field, uri, err)
+	}
+
+	contentType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if contentType == "" || contentType == "application/octet-stream" {
+		contentType, _, _ = mime.ParseMediaType(http.DetectContentType(head))
+	}
+	if !strings.HasPrefix(contentType, "image/") {
+		return fmt.Errorf("%s %s is %s, not an image", field, uri, contentType)
+	}
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(head))
+	if err != nil {
+		log.Printf("Unable to read the dimensions of %s %s (%s): %v", field, uri, contentType, err)
+		return nil
+	}
+	log.Printf("%s %s is a %dx%d %s image", field, uri, config.Width, config.Height, format)
+	if want, ok := imageAspectRatios[field]; ok && config.Height > 0 {
+		got := float64(config.Width) / float64(config.Height)
+		if math.Abs(got/want-1) > 0.1 {
+			log.Printf("Warning: %s %s has an aspect ratio of %.2f, but %.2f is recommended; it will be cropped", field, uri, got, want)
+		}
+	}
+	return nil
+}
+
+// Build an image.
+//
+// description is read out by screen readers, and can be empty for purely
+// decorative images.
+func newImage(uri, description string) *walletobjects.Image {
+	image := &walletobjects.Image{
+		SourceUri: &walletobjects.ImageUri{
+			Uri: uri,
+		},
+	}
+	if description != "" {
+		image.ContentDescription = &walletobjects.LocalizedString{
+			DefaultValue: &walletobjects.TranslatedString{
+				Language: "en-us",
+				Value:    description,
+			},
+		}
+	}
+	return image
+}
+
+// Rewrite the URIs of images to go through d.imageProxy.
+//
+// The original URI is query escaped and appended to the proxy prefix, so a
+// prefix of "https://proxy.example.com/fetch?url=" turns
+// "https://cdn.example.com/a.png" into
+// "https://proxy.example.com/fetch?url=https%3A%2F%2Fcdn.example.com%2Fa.png".
+// Each image is replaced by a copy, leaving the original unchanged. Nil
+// images are skipped.
+func (d *demoOffer) proxyImages(images ...**walletobjects.Image) error {
+	if d.imageProxy == "" {
+		return nil
+	}
+	proxy, err := url.Parse(d.imageProxy)
+	if err != nil || proxy.Scheme != "https" || proxy.Host == "" {
+		return fmt.Errorf("image proxy %q must be an absolute https URL", d.imageProxy)
+	}
+	for _, image := range images {
+		if *image == nil || (*image).SourceUri == nil {
+			continue
+		}
+		proxied := **image
+		sourceUri := *proxied.SourceUri
+		sourceUri.Uri = d.imageProxy + url.QueryEscape(sourceUri.Uri)
+		proxied.SourceUri = &sourceUri
+		*image = &proxied
+	}
+	return nil
+}
+
+// Build the hero image for a market.
+//
+// An Image has a single URI, which isn't localized: unlike its
+// contentDescription, it can't carry a different URI per language. To show
+// market-specific creative, the image is instead chosen when the object is
+// created, from uris keyed by locale, e.g. "en-US" or "es". An exact match
+// for locale is used first, then a match for its language, then any locale
+// of the same language. If nothing matches, defaultUri is used.
+func localizedHeroImage(locale, defaultUri string, uris map[string]string, description *walletobjects.LocalizedString) *walletobjects.Image {
+	return &walletobjects.Image{
+		SourceUri: &walletobjects.ImageUri{
+			Uri: matchLocale(locale, defaultUri, uris),
+		},
+		ContentDescription: description,
+	}
+}
+
+// Pick the value for the best match of locale in values, or def if there
+// is none.
+func matchLocale(locale, def string, values map[string]string) string {
+	language, _, _ := strings.Cut(locale, "-")
+	var sameLanguage []string
+	for key, value := range values {
+		if strings.EqualFold(key, locale) {
+			return value
+		}
+		keyLanguage, _, _ := strings.Cut(key, "-")
+		if strings.EqualFold(keyLanguage, language) {
+			sameLanguage = append(sameLanguage, key)
+		}
+	}
+	if len(sameLanguage) == 0 {
+		return def
+	}
+	// Prefer the bare language, then the first region in sorted order, so
+	// the choice doesn't depend on map order
+	sort.Strings(sameLanguage)
+	for _, key := range sameLanguage {
+		if !strings.Contains(key, "-") {
+			return values[key]
+		}
+	}
+	return values[sameLanguage[0]]
+}
+
+// Build a URI for the links module.
+//
+// localizedDescription is optional. The plain description is still sent
+// alongside it, and is used where no translation matches the user's locale.
+func newLinkUri(id, uri, description string, localizedDescription *walletobjects.LocalizedString) *walletobjects.Uri {
+	return &walletobjects.Uri{
+		Id:                   id,
+		Uri:                  uri,
+		Description:          description,
+		LocalizedDescription: localizedDescription,
+	}
+}
+
+// The maximum length of a class or object ID, including the issuer ID
+// prefix. Longer IDs are rejected by the API with an error that doesn't
+// say which part of the ID is at fault.
+const maxIdLength = 255
+
+// Build a class ID from the issuer ID and class suffix.
+func classId(issuerId, classSuffix string) (string, error) {
+	return walletId(issuerId, classSuffix, "class suffix")
+}
+
+// Build an object ID from the issuer ID and object suffix.
+func objectId(issuerId, objectSuffix string) (string, error) {
+	return walletId(issuerId, objectSuffix, "object suffix")
+}
+
+// Check that an object ID has the form issuerId.objectSuffix.
+func validateObjectId(id string) error {
+	parsed, err := ParseID(id)
+	if err != nil {
+		return err
+	}
+	_, err = objectId(parsed.IssuerID, parsed.Suffix)
+	return err
+}
+
+// ID of a class or object: the issuer ID and a suffix chosen by the
+// issuer, joined by a dot.
+type ID struct {
+	IssuerID string
+	Suffix   string
+}
+
+func (id ID) String() string {
+	return id.IssuerID + "." + id.Suffix
+}
+
+// Split a class or object ID into its issuer ID and suffix.
+//
+// Suffixes may themselves contain dots, so the ID is split at the first
+// dot; the issuer ID before it must be numeric.
+func ParseID(s string) (ID, error) {
+	issuerId, suffix, ok := strings.Cut(s, ".")
+	if !ok {
+		return ID{}, fmt.Errorf("%w %q: no issuer ID prefix", ErrInvalidID, s)
+	}
+	if _, err := strconv.ParseInt(issuerId, 10, 64); err != nil {
+		return ID{}, fmt.Errorf("%w %q: issuer ID %q is not a number", ErrInvalidID, s, issuerId)
+	}
+	if suffix == "" {
+		return ID{}, fmt.Errorf("%w %q: empty suffix", ErrInvalidID, s)
+	}
+	return ID{IssuerID: issuerId, Suffix: suffix}, nil
+}
+
+// Characters allowed in a class or object suffix.
+var idSuffixPattern = regexp.MustCompile(`^[a-zA-Z0-9._-]+$`)
+
+func walletId(issuerId, suffix, name string) (string, error) {
+	if !idSuffixPattern.MatchString(suffix) {
+		return "", fmt.Errorf("%w: %s %q must only contain alphanumeric characters, '.', '_' or '-'", ErrInvalidID, name, suffix)
+	}
+	id := ID{IssuerID: issuerId, Suffix: suffix}.String()
+	if len(id) > maxIdLength {
+		return "", fmt.Errorf("%w: %s %q makes the ID %d characters long (maximum %d)", ErrInvalidID, name, suffix, len(id), maxIdLength)
+	}
+	return id, nil
+}
+
+// Compute a deterministic object ID for a user.
+//
+// The object suffix is derived from a SHA-256 hash of the user key, so the
+// same user always maps to the same object in a class. Objects can then be
+// upserted per user without storing which suffix was issued to whom. The
+// user key itself doesn't appear in the ID.
+func stableObjectID(issuerId, classSuffix, userKey string) (string, error) {
+	hash := sha256.Sum256([]byte(userKey))
+	return objectId(issuerId, fmt.Sprintf("%s-%x", classSuffix, hash))
+}
 
 func main() {
 	issuerId := os.Getenv("WALLET_ISSUER_ID")
@@ -316,11 +4158,69 @@ func main() {
 
 	d := demoOffer{}
 
-	d.auth()
-	d.createClass(issuerId, classSuffix)
-	d.createObject(issuerId, classSuffix, objectSuffix)
-	d.expireObject(issuerId, objectSuffix)
-	d.createJwtNewObjects(issuerId, classSuffix, objectSuffix)
-	d.createJwtExistingObjects(issuerId, classSuffix, objectSuffix)
-	d.batchCreateObjects(issuerId, classSuffix)
+	// Every other step needs an authenticated client.
+	if err := d.auth(); err != nil {
+		log.Fatal(err)
+	}
+
+	if len(os.Args) > 1 {
+		if err := d.checkPermissions(context.Background(), issuerId); err != nil {
+			log.Fatal(err)
+		}
+		switch os.Args[1] {
+		case "watch-review":
+			if err := watchReviewCommand(&d, issuerId, os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+		default:
+			log.Fatalf("Unknown command %q", os.Args[1])
+		}
+		return
+	}
+
+	// The remaining steps run even if an earlier one fails, so a single
+	// run exercises every operation.
+	steps := []struct {
+		name string
+		run  func() (*Result, error)
+	}{
+		{"checkPermissions", func() (*Result, error) { return nil, d.checkPermissions(context.Background(), issuerId) }},
+		{"createClass", func() (*Result, error) { return d.createClass(issuerId, classSuffix, nil) }},
+		{"createPriceReductionClass", func() (*Result, error) {
+			return d.createClass(issuerId, classSuffix+"_price_reduction", demoPriceReductionClassConfig())
+		}},
+		{"createObject", func() (*Result, error) { return d.createObject(issuerId, classSuffix, objectSuffix, nil) }},
+		{"expireObject", func() (*Result, error) { return d.expireObject(issuerId, objectSuffix, false) }},
+		{"createJwtNewObjects", func() (*Result, error) { return d.createJwtNewObjects(issuerId, classSuffix, objectSuffix, nil) }},
+		{"createJwtExistingObjects", func() (*Result, error) { return d.createJwtExistingObjects(issuerId, classSuffix, objectSuffix) }},
+		{"batchCreateObjects", func() (*Result, error) {
+			ids, err := d.batchCreateObjects(issuerId, classSuffix)
+			fmt.Printf("Batch insert ids:\n%s\n", strings.Join(ids, "\n"))
+			return nil, err
+		}},
+	}
+
+	errs := make([]error, len(steps))
+	failed := false
+	for i, step := range steps {
+		var res *Result
+		if res, errs[i] = step.run(); errs[i] != nil {
+			fmt.Printf("%s failed: %v\n", step.name, errs[i])
+			failed = true
+		} else if res != nil {
+			fmt.Println(res)
+		}
+	}
+
+	fmt.Println("Summary:")
+	for i, step := range steps {
+		if errs[i] != nil {
+			fmt.Printf("  FAIL %s\n", step.name)
+		} else {
+			fmt.Printf("  PASS %s\n", step.name)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,1930 @@
+//go:build offer
+
+/*
+ * Copyright 2023 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/golang-jwt/jwt"
+	"golang.org/x/net/html"
+	oauthJwt "golang.org/x/oauth2/jwt"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	"google.golang.org/api/walletobjects/v1"
+	"io"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	testIssuerId = "1234567890"
+	testEmail    = "demo@example.iam.gserviceaccount.com"
+)
+
+var (
+	testKeyOnce sync.Once
+	testKey     *rsa.PrivateKey
+	testKeyPEM  []byte
+)
+
+// An RSA key for signing test JWTs, generated once as it's slow.
+func testRSAKey(t *testing.T) (*rsa.PrivateKey, []byte) {
+	t.Helper()
+	testKeyOnce.Do(func() {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			panic(err)
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			panic(err)
+		}
+		testKey = key
+		testKeyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	})
+	return testKey, testKeyPEM
+}
+
+// A service account key file for the test key, with the given fields
+// replaced, or removed if their value is nil.
+func testCredentialsJSON(t *testing.T, replace map[string]any) []byte {
+	t.Helper()
+	_, keyPEM := testRSAKey(t)
+	file := map[string]any{
+		"type":           "service_account",
+		"project_id":     "demo",
+		"private_key_id": "test",
+		"private_key":    string(keyPEM),
+		"client_email":   testEmail,
+		"client_id":      "1",
+		"token_uri":      "https://oauth2.googleapis.com/token",
+	}
+	for name, value := range replace {
+		if value == nil {
+			delete(file, name)
+		} else {
+			file[name] = value
+		}
+	}
+	b, err := json.Marshal(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// Start a server for the API calls of a demoOffer, and return a demoOffer
+// that sends its calls to it. The server also hands out access tokens for
+// the calls that authenticate with the credentials.
+func newTestDemo(t *testing.T, handler http.Handler) *demoOffer {
+	t.Helper()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"access_token": "test-token", "token_type": "Bearer", "expires_in": 3600}`)
+	})
+	mux.Handle("/", handler)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	service, err := walletobjects.NewService(context.Background(),
+		option.WithHTTPClient(srv.Client()), option.WithEndpoint(srv.URL+"/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, keyPEM := testRSAKey(t)
+	return &demoOffer{
+		credentials: &oauthJwt.Config{
+			Email:      testEmail,
+			PrivateKey: keyPEM,
+			TokenURL:   srv.URL + "/token",
+		},
+		service: service,
+	}
+}
+
+// Check the signature of a JWT signed with the test key, and return its
+// claims.
+func parseTestJWT(t *testing.T, token string) jwt.MapClaims {
+	t.Helper()
+	key, _ := testRSAKey(t)
+	parsed, err := jwt.Parse(token, func(token *jwt.Token) (any, error) {
+		if token.Method != jwt.SigningMethodRS256 {
+			return nil, fmt.Errorf("token is signed with %s, want RS256", token.Method.Alg())
+		}
+		return &key.PublicKey, nil
+	})
+	if err != nil {
+		t.Fatalf("invalid JWT: %v", err)
+	}
+	return parsed.Claims.(jwt.MapClaims)
+}
+
+// Write a JSON response.
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// An error response body in the API's format.
+func apiError(status int, message string) map[string]any {
+	return map[string]any{
+		"error": map[string]any{"code": status, "message": message},
+	}
+}
+
+// Handle object inserts, storing the JSON body of the last one in inserted
+// and echoing it back.
+func insertHandler(t *testing.T, inserted *map[string]any) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/walletobjects/v1/offerObject" {
+			t.Errorf("unexpected %s %s request", r.Method, r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+		*inserted = nil
+		if err := json.NewDecoder(r.Body).Decode(inserted); err != nil {
+			t.Errorf("insert body: %v", err)
+		}
+		writeJSON(w, http.StatusOK, *inserted)
+	})
+}
+
+// One API call in a batch request, as received by batchHandler.
+type batchCall struct {
+	method string
+	path   string
+	body   []byte
+}
+
+// Handle batch requests, answering each API call in them with respond.
+//
+// The request is parsed strictly: every part must be application/json
+// with a Content-ID, and hold an HTTP request with CRLF line endings. The
+// calls of each request are sent on calls if it isn't nil.
+func batchHandler(t *testing.T, calls chan<- []batchCall, respond func(call batchCall) (int, any)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/batch" || r.Method != http.MethodPost {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+		received, err := parseBatchRequest(r.Header.Get("Content-Type"), r.Body)
+		if err != nil {
+			t.Errorf("invalid batch request: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if calls != nil {
+			calls <- received
+		}
+
+		body := new(bytes.Buffer)
+		writer := multipart.NewWriter(body)
+		for i, call := range received {
+			status, v := respond(call)
+			b, _ := json.Marshal(v)
+			header := make(textproto.MIMEHeader)
+			header.Set("Content-Type", "application/http")
+			header.Set("Content-ID", "response-"+strconv.Itoa(i+1))
+			part, _ := writer.CreatePart(header)
+			fmt.Fprintf(part, "HTTP/1.1 %d %s\r\nContent-Type: application/json\r\n\r\n%s", status, http.StatusText(status), b)
+		}
+		writer.Close()
+		w.Header().Set("Content-Type", "multipart/mixed; boundary="+writer.Boundary())
+		w.Write(body.Bytes())
+	})
+}
+
+// Parse the body of a batch request into the API calls it holds.
+func parseBatchRequest(contentType string, r io.Reader) ([]batchCall, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, err
+	}
+	if mediaType != "multipart/mixed" {
+		return nil, fmt.Errorf("content type is %s, want multipart/mixed", mediaType)
+	}
+	var calls []batchCall
+	reader := multipart.NewReader(r, params["boundary"])
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return calls, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if got := part.Header.Get("Content-Type"); got != "application/json" {
+			return nil, fmt.Errorf("part %d has content type %q, want application/json", len(calls)+1, got)
+		}
+		if got, want := part.Header.Get("Content-ID"), strconv.Itoa(len(calls)+1); got != want {
+			return nil, fmt.Errorf("part %d has Content-ID %q, want %q", len(calls)+1, got, want)
+		}
+		raw, err := io.ReadAll(part)
+		if err != nil {
+			return nil, err
+		}
+		head, _, _ := bytes.Cut(raw, []byte("\r\n\r\n"))
+		if bytes.Count(head, []byte("\n")) != bytes.Count(head, []byte("\r\n")) {
+			return nil, fmt.Errorf("part %d has a bare LF in its request line or headers: %q", len(calls)+1, head)
+		}
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(raw)))
+		if err != nil {
+			return nil, fmt.Errorf("part %d: %w", len(calls)+1, err)
+		}
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			return nil, fmt.Errorf("part %d: %w", len(calls)+1, err)
+		}
+		calls = append(calls, batchCall{method: req.Method, path: req.URL.Path, body: body})
+	}
+}
+
+func TestBatchRequestBody(t *testing.T) {
+	tests := []struct {
+		name string
+		ops  []batchOperation
+	}{
+		{"single insert", []batchOperation{
+			{method: "POST", path: "/walletobjects/v1/offerObject", body: []byte(`{"id":"1234567890.a"}`)},
+		}},
+		{"gets without bodies", []batchOperation{
+			{method: "GET", path: "/walletobjects/v1/offerObject/1234567890.a"},
+			{method: "GET", path: "/walletobjects/v1/offerObject/1234567890.b"},
+		}},
+		{"mixed", []batchOperation{
+			{method: "PATCH", path: "/walletobjects/v1/offerObject/1234567890.a", body: []byte(`{"state":"EXPIRED"}`)},
+			{method: "GET", path: "/walletobjects/v1/offerObject/1234567890.b"},
+			{method: "POST", path: "/walletobjects/v1/offerObject", body: []byte("{\n  \"id\": \"1234567890.c\"\n}")},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			body, contentType, err := batchRequestBody(test.ops)
+			if err != nil {
+				t.Fatal(err)
+			}
+			calls, err := parseBatchRequest(contentType, body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(calls) != len(test.ops) {
+				t.Fatalf("got %d parts, want %d", len(calls), len(test.ops))
+			}
+			for i, op := range test.ops {
+				call := calls[i]
+				if call.method != op.method || call.path != op.path || !bytes.Equal(call.body, op.body) {
+					t.Errorf("part %d is %s %s %q, want %s %s %q", i+1, call.method, call.path, call.body, op.method, op.path, op.body)
+				}
+			}
+		})
+	}
+}
+
+func TestBatchCreateObjects(t *testing.T) {
+	calls := make(chan []batchCall, 1)
+	d := newTestDemo(t, batchHandler(t, calls, func(call batchCall) (int, any) {
+		var offerObject walletobjects.OfferObject
+		json.Unmarshal(call.body, &offerObject)
+		return http.StatusOK, offerObject
+	}))
+
+	ids, err := d.batchCreateObjects(testIssuerId, "class")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 3 {
+		t.Fatalf("got %d IDs, want 3", len(ids))
+	}
+	received := <-calls
+	for i, call := range received {
+		if call.method != "POST" || call.path != "/walletobjects/v1/offerObject" {
+			t.Errorf("call %d is %s %s, want POST /walletobjects/v1/offerObject", i+1, call.method, call.path)
+		}
+		var offerObject walletobjects.OfferObject
+		if err := json.Unmarshal(call.body, &offerObject); err != nil {
+			t.Errorf("call %d body: %v", i+1, err)
+		}
+		if offerObject.Id != ids[i] || offerObject.ClassId != testIssuerId+".class" {
+			t.Errorf("call %d inserts %s in %s, want %s in %s.class", i+1, offerObject.Id, offerObject.ClassId, ids[i], testIssuerId)
+		}
+	}
+}
+
+func TestWrapAPIError(t *testing.T) {
+	other := errors.New("connection reset")
+	tests := []struct {
+		name      string
+		err       error
+		notFound  error
+		exists    error
+		wantIs    error
+		wantNotIs []error
+	}{
+		{"not found", &googleapi.Error{Code: http.StatusNotFound}, ErrObjectNotFound, ErrObjectExists, ErrObjectNotFound, []error{ErrObjectExists}},
+		{"conflict", &googleapi.Error{Code: http.StatusConflict}, ErrObjectNotFound, ErrObjectExists, ErrObjectExists, []error{ErrObjectNotFound}},
+		{"class not found", &googleapi.Error{Code: http.StatusNotFound}, ErrClassNotFound, nil, ErrClassNotFound, []error{ErrObjectNotFound}},
+		{"not found without sentinel", &googleapi.Error{Code: http.StatusNotFound}, nil, ErrClassExists, nil, []error{ErrClassNotFound, ErrClassExists}},
+		{"conflict without sentinel", &googleapi.Error{Code: http.StatusConflict}, ErrClassNotFound, nil, nil, []error{ErrClassNotFound, ErrClassExists}},
+		{"server error", &googleapi.Error{Code: http.StatusInternalServerError}, ErrObjectNotFound, ErrObjectExists, nil, []error{ErrObjectNotFound, ErrObjectExists}},
+		{"wrapped", fmt.Errorf("unable to get object: %w", &googleapi.Error{Code: http.StatusNotFound}), ErrObjectNotFound, nil, ErrObjectNotFound, nil},
+		{"not an API error", other, ErrObjectNotFound, ErrObjectExists, other, []error{ErrObjectNotFound, ErrObjectExists}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := fmt.Errorf("unable to do it: %w", wrapAPIError(test.err, test.notFound, test.exists))
+			if test.wantIs != nil && !errors.Is(err, test.wantIs) {
+				t.Errorf("errors.Is(%v, %v) = false, want true", err, test.wantIs)
+			}
+			for _, target := range test.wantNotIs {
+				if errors.Is(err, target) {
+					t.Errorf("errors.Is(%v, %v) = true, want false", err, target)
+				}
+			}
+			var apiErr *googleapi.Error
+			if errors.As(test.err, &apiErr) && !errors.As(err, &apiErr) {
+				t.Errorf("errors.As(%v, *googleapi.Error) = false, want true", err)
+			}
+		})
+	}
+}
+
+func TestWrapAPIErrorNil(t *testing.T) {
+	if err := wrapAPIError(nil, ErrObjectNotFound, ErrObjectExists); err != nil {
+		t.Errorf("wrapAPIError(nil) = %v, want nil", err)
+	}
+}
+
+// Errors returned by the API reach callers wrapped in the sentinel
+// errors, whichever method made the call.
+func TestAPIErrorsIs(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		call   func(d *demoOffer) error
+		want   error
+	}{
+		{"createObject conflict", http.StatusConflict, func(d *demoOffer) error {
+			_, err := d.createObject(testIssuerId, "class", "object", nil)
+			return err
+		}, ErrObjectExists},
+		{"createClass conflict", http.StatusConflict, func(d *demoOffer) error {
+			_, err := d.createClass(testIssuerId, "class", nil)
+			return err
+		}, ErrClassExists},
+		{"expireObject not found", http.StatusNotFound, func(d *demoOffer) error {
+			_, err := d.expireObject(testIssuerId, "object", false)
+			return err
+		}, ErrObjectNotFound},
+		{"updateAppLink not found", http.StatusNotFound, func(d *demoOffer) error {
+			return d.updateAppLink(testIssuerId, "object", "", "", "https://example.com", nil)
+		}, ErrObjectNotFound},
+		{"updateBarcodeValue not found", http.StatusNotFound, func(d *demoOffer) error {
+			return d.updateBarcodeValue(testIssuerId, "object", "NEW-CODE")
+		}, ErrObjectNotFound},
+		{"cloneClass not found", http.StatusNotFound, func(d *demoOffer) error {
+			_, err := d.cloneClass(testIssuerId, "missing", "copy")
+			return err
+		}, ErrClassNotFound},
+		{"addTranslation not found", http.StatusNotFound, func(d *demoOffer) error {
+			return d.addTranslation(testIssuerId, "class", "fr", "Titre")
+		}, ErrClassNotFound},
+		{"addClassMessage not found", http.StatusNotFound, func(d *demoOffer) error {
+			return d.addClassMessage(testIssuerId, "class", &walletobjects.Message{Header: "Header", Body: "Body"}, false)
+		}, ErrClassNotFound},
+		{"listClassMessages not found", http.StatusNotFound, func(d *demoOffer) error {
+			_, err := d.listClassMessages(testIssuerId, "class")
+			return err
+		}, ErrClassNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := newTestDemo(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				writeJSON(w, test.status, apiError(test.status, http.StatusText(test.status)))
+			}))
+			err := test.call(d)
+			if !errors.Is(err, test.want) {
+				t.Errorf("got error %v, want one wrapping %v", err, test.want)
+			}
+			var apiErr *googleapi.Error
+			if !errors.As(err, &apiErr) || apiErr.Code != test.status {
+				t.Errorf("got error %v, want one wrapping a %d API error", err, test.status)
+			}
+		})
+	}
+}
+
+func TestBatchErrorsIs(t *testing.T) {
+	d := newTestDemo(t, batchHandler(t, nil, func(call batchCall) (int, any) {
+		return http.StatusNotFound, apiError(http.StatusNotFound, "not found")
+	}))
+	results, err := d.batchExpireObjects(testIssuerId, []string{"a", "b"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, result := range results {
+		if !errors.Is(result.Err, ErrObjectNotFound) {
+			t.Errorf("%s: got error %v, want one wrapping %v", result.ID, result.Err, ErrObjectNotFound)
+		}
+	}
+}
+
+func TestParseID(t *testing.T) {
+	tests := []struct {
+		id       string
+		issuerId string
+		suffix   string
+	}{
+		{"1234567890.class", "1234567890", "class"},
+		// Only the first dot separates the issuer ID
+		{"1234567890.summer.sale", "1234567890", "summer.sale"},
+		{"1.a_b-c", "1", "a_b-c"},
+	}
+	for _, tt := range tests {
+		id, err := ParseID(tt.id)
+		if err != nil {
+			t.Errorf("ParseID(%q): %v", tt.id, err)
+			continue
+		}
+		if id.IssuerID != tt.issuerId || id.Suffix != tt.suffix {
+			t.Errorf("ParseID(%q) = %+v, want issuer %s and suffix %s", tt.id, id, tt.issuerId, tt.suffix)
+		}
+		if id.String() != tt.id {
+			t.Errorf("ParseID(%q).String() = %q", tt.id, id.String())
+		}
+	}
+}
+
+func TestParseIDInvalid(t *testing.T) {
+	for _, id := range []string{"", "no-dot", "issuer.suffix", "1234567890."} {
+		if _, err := ParseID(id); !errors.Is(err, ErrInvalidID) {
+			t.Errorf("ParseID(%q) = %v, want an error wrapping %v", id, err, ErrInvalidID)
+		}
+	}
+}
+
+func TestBatchInsertCollisions(t *testing.T) {
+	tests := []struct {
+		name          string
+		suffixes      []string
+		existing      []string
+		checkExisting bool
+		wantErr       string
+	}{
+		{"unique", []string{"a", "b"}, nil, false, ""},
+		{"repeated", []string{"a", "b", "a"}, nil, false, "a"},
+		{"existing not checked", []string{"a", "b"}, []string{"b"}, false, ""},
+		{"existing", []string{"a", "b"}, []string{"b"}, true, "b"},
+		{"repeated and existing", []string{"a", "a", "b"}, []string{"a", "b"}, true, "a, b"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			inserted := 0
+			d := newTestDemo(t, batchHandler(t, nil, func(call batchCall) (int, any) {
+				if call.method == "GET" {
+					for _, suffix := range test.existing {
+						if strings.HasSuffix(call.path, "."+suffix) {
+							return http.StatusOK, walletobjects.OfferObject{Id: testIssuerId + "." + suffix}
+						}
+					}
+					return http.StatusNotFound, apiError(http.StatusNotFound, "not found")
+				}
+				inserted++
+				var offerObject walletobjects.OfferObject
+				json.Unmarshal(call.body, &offerObject)
+				return http.StatusOK, offerObject
+			}))
+			d.checkExistingObjects = test.checkExisting
+
+			var offerObjects []*walletobjects.OfferObject
+			for _, suffix := range test.suffixes {
+				offerObjects = append(offerObjects, &walletobjects.OfferObject{
+					Id:      testIssuerId + "." + suffix,
+					ClassId: testIssuerId + ".class",
+					State:   string(StateActive),
+				})
+			}
+			_, err := d.batchCreateObjectsAcrossClasses(testIssuerId, offerObjects)
+			if test.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if inserted != len(test.suffixes) {
+					t.Errorf("inserted %d objects, want %d", inserted, len(test.suffixes))
+				}
+				return
+			}
+			if err == nil || !strings.HasSuffix(err.Error(), ": "+test.wantErr) {
+				t.Errorf("got error %v, want one listing %s", err, test.wantErr)
+			}
+			if inserted != 0 {
+				t.Errorf("inserted %d objects, want none", inserted)
+			}
+		})
+	}
+}
+
+func TestImportCSVRepeatedSuffix(t *testing.T) {
+	d := newTestDemo(t, batchHandler(t, nil, func(call batchCall) (int, any) {
+		t.Errorf("unexpected %s %s", call.method, call.path)
+		return http.StatusOK, nil
+	}))
+	csv := "objectSuffix,barcodeValue,state\na,CODE-1,ACTIVE\nb,CODE-2,ACTIVE\na,CODE-3,ACTIVE\n"
+	_, err := d.importCSV(context.Background(), testIssuerId, "class", strings.NewReader(csv), nil)
+	if err == nil || !strings.Contains(err.Error(), "collide") {
+		t.Errorf("got error %v, want a collision", err)
+	}
+}
+
+func TestUpdateObjectFieldsClearsEmptyValues(t *testing.T) {
+	tests := []struct {
+		name   string
+		object *walletobjects.OfferObject
+		fields []string
+		want   map[string]any
+	}{
+		{"nil slice", &walletobjects.OfferObject{}, []string{"Locations"}, map[string]any{"locations": nil}},
+		{"empty slice", &walletobjects.OfferObject{Locations: []*walletobjects.LatLongPoint{}}, []string{"Locations"}, map[string]any{"locations": nil}},
+		{"empty string", &walletobjects.OfferObject{}, []string{"State"}, map[string]any{"state": nil}},
+		{"nil pointer", &walletobjects.OfferObject{}, []string{"HeroImage"}, map[string]any{"heroImage": nil}},
+		{"set slice", &walletobjects.OfferObject{TextModulesData: []*walletobjects.TextModuleData{{Header: "Header"}}}, []string{"TextModulesData"},
+			map[string]any{"textModulesData": []any{map[string]any{"header": "Header"}}}},
+		{"only named fields", &walletobjects.OfferObject{State: "EXPIRED", Locations: []*walletobjects.LatLongPoint{}}, []string{"State"},
+			map[string]any{"state": "EXPIRED"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got map[string]any
+			d := newTestDemo(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodPatch {
+					t.Errorf("got %s request, want PATCH", r.Method)
+				}
+				json.NewDecoder(r.Body).Decode(&got)
+				writeJSON(w, http.StatusOK, walletobjects.OfferObject{Id: testIssuerId + ".object"})
+			}))
+			if _, err := d.updateObjectFields(testIssuerId, "object", test.object, test.fields...); err != nil {
+				t.Fatal(err)
+			}
+			gotJson, _ := json.Marshal(got)
+			wantJson, _ := json.Marshal(test.want)
+			if !bytes.Equal(gotJson, wantJson) {
+				t.Errorf("patch body is %s, want %s", gotJson, wantJson)
+			}
+		})
+	}
+}
+
+// Progress is reported once per batch request, after it completes, and
+// never from two goroutines at once.
+func TestBatchInsertProgress(t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+	inserts := batchHandler(t, nil, func(call batchCall) (int, any) {
+		var offerObject walletobjects.OfferObject
+		json.Unmarshal(call.body, &offerObject)
+		return http.StatusOK, offerObject
+	})
+	d := newTestDemo(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		inserts.ServeHTTP(w, r)
+	}))
+
+	total := 2*maxBatchOperations + 500
+	offerObjects := make([]*walletobjects.OfferObject, total)
+	for i := range offerObjects {
+		offerObjects[i] = &walletobjects.OfferObject{
+			Id:      fmt.Sprintf("%s.object%d", testIssuerId, i),
+			ClassId: testIssuerId + ".class",
+			State:   string(StateActive),
+		}
+	}
+	type report struct{ done, total, requests int }
+	// Appended to without a lock, so the race detector catches concurrent
+	// calls as well as the running count
+	var reports []report
+	var running int32
+	progress := func(done, total int) {
+		if n := atomic.AddInt32(&running, 1); n != 1 {
+			t.Errorf("progress called with %d calls running", n)
+		}
+		defer atomic.AddInt32(&running, -1)
+		mu.Lock()
+		sent := requests
+		mu.Unlock()
+		reports = append(reports, report{done, total, sent})
+	}
+	results, err := d.batchInsertObjects(context.Background(), testIssuerId, offerObjects, progress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != total {
+		t.Fatalf("got %d results, want %d", len(results), total)
+	}
+	want := []report{
+		{maxBatchOperations, total, 1},
+		{2 * maxBatchOperations, total, 2},
+		{total, total, 3},
+	}
+	if !reflect.DeepEqual(reports, want) {
+		t.Errorf("progress reports (done, total, requests sent) are %v, want %v", reports, want)
+	}
+}
+
+// A batch request that fails after others succeeded doesn't lose the
+// results of the objects already inserted.
+func TestBatchInsertPartialFailure(t *testing.T) {
+	requests := 0
+	inserts := batchHandler(t, nil, func(call batchCall) (int, any) {
+		var offerObject walletobjects.OfferObject
+		json.Unmarshal(call.body, &offerObject)
+		return http.StatusOK, offerObject
+	})
+	d := newTestDemo(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests > 1 {
+			http.Error(w, "backend unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		inserts.ServeHTTP(w, r)
+	}))
+
+	total := maxBatchOperations + 10
+	offerObjects := make([]*walletobjects.OfferObject, total)
+	for i := range offerObjects {
+		offerObjects[i] = &walletobjects.OfferObject{
+			Id:      fmt.Sprintf("%s.object%d", testIssuerId, i),
+			ClassId: testIssuerId + ".class",
+			State:   string(StateActive),
+		}
+	}
+	results, err := d.batchInsertObjects(context.Background(), testIssuerId, offerObjects, nil)
+	if err == nil {
+		t.Fatal("got no error for the failed batch request")
+	}
+	if len(results) != maxBatchOperations {
+		t.Fatalf("got %d results, want %d for the first batch request", len(results), maxBatchOperations)
+	}
+	for i, result := range results {
+		if result.ID != offerObjects[i].Id || result.Err != nil {
+			t.Fatalf("result %d is %s, %v, want %s inserted", i, result.ID, result.Err, offerObjects[i].Id)
+		}
+	}
+
+	requests = 0
+	ids, err := d.batchCreateObjectsAcrossClasses(testIssuerId, offerObjects)
+	if err == nil || len(ids) != maxBatchOperations {
+		t.Errorf("got %d IDs and error %v, want %d IDs and an error", len(ids), err, maxBatchOperations)
+	}
+}
+
+func TestImportCSVPartialFailure(t *testing.T) {
+	requests := 0
+	inserts := batchHandler(t, nil, func(call batchCall) (int, any) {
+		var offerObject walletobjects.OfferObject
+		json.Unmarshal(call.body, &offerObject)
+		return http.StatusOK, offerObject
+	})
+	d := newTestDemo(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests > 1 {
+			http.Error(w, "backend unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		inserts.ServeHTTP(w, r)
+	}))
+
+	var csv strings.Builder
+	csv.WriteString("objectSuffix,barcodeValue,state\n")
+	csv.WriteString("bad,CODE,UNKNOWN_STATE\n")
+	for i := 0; i < maxBatchOperations+5; i++ {
+		fmt.Fprintf(&csv, "object%d,CODE-%d,ACTIVE\n", i, i)
+	}
+	results, err := d.importCSV(context.Background(), testIssuerId, "class", strings.NewReader(csv.String()), nil)
+	if err == nil {
+		t.Fatal("got no error for the failed batch request")
+	}
+	if len(results) != 1+maxBatchOperations {
+		t.Fatalf("got %d results, want the bad row and %d inserted rows", len(results), maxBatchOperations)
+	}
+	if results[0].ID != testIssuerId+".bad" || results[0].Err == nil {
+		t.Errorf("bad row result is %s, %v, want %s.bad with an error", results[0].ID, results[0].Err, testIssuerId)
+	}
+	for i, result := range results[1:] {
+		if want := fmt.Sprintf("%s.object%d", testIssuerId, i); result.ID != want || result.Err != nil {
+			t.Fatalf("row result %d is %s, %v, want %s inserted", i, result.ID, result.Err, want)
+		}
+	}
+}
+
+func TestNewObjectLinkExistingClass(t *testing.T) {
+	d := newTestDemo(t, http.NotFoundHandler())
+	if _, err := d.newObjectLinkExistingClass(testIssuerId, "class", "object", nil); err == nil {
+		t.Error("got no error for a nil object")
+	}
+
+	obj := &walletobjects.OfferObject{Barcode: &walletobjects.Barcode{Type: "QR_CODE", Value: "CODE"}}
+	link, err := d.newObjectLinkExistingClass(testIssuerId, "class", "object", obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if obj.Id != "" || obj.State != "" {
+		t.Errorf("object passed in was modified: %+v", obj)
+	}
+	claims := parseTestJWT(t, strings.TrimPrefix(link, saveUrlPrefix))
+	payload := claims["payload"].(map[string]any)
+	if _, ok := payload["offerClasses"]; ok {
+		t.Error("payload includes offerClasses")
+	}
+	objects := payload["offerObjects"].([]any)
+	got := objects[0].(map[string]any)
+	if got["id"] != testIssuerId+".object" || got["classId"] != testIssuerId+".class" || got["state"] != "ACTIVE" {
+		t.Errorf("got object %v", got)
+	}
+}
+
+func TestAddTranslationPatchesOnlyTitle(t *testing.T) {
+	var patch map[string]any
+	d := newTestDemo(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, walletobjects.OfferClass{
+				Id:           testIssuerId + ".class",
+				Title:        "Offer title",
+				ReviewStatus: "APPROVED",
+			})
+		case http.MethodPatch:
+			json.NewDecoder(r.Body).Decode(&patch)
+			writeJSON(w, http.StatusOK, walletobjects.OfferClass{Id: testIssuerId + ".class"})
+		default:
+			t.Errorf("unexpected %s request", r.Method)
+		}
+	}))
+	if err := d.addTranslation(testIssuerId, "class", "fr", "Titre de l'offre"); err != nil {
+		t.Fatal(err)
+	}
+	if len(patch) != 1 || patch["localizedTitle"] == nil {
+		t.Fatalf("patch is %v, want only localizedTitle", patch)
+	}
+	b, _ := json.Marshal(patch["localizedTitle"])
+	var title walletobjects.LocalizedString
+	json.Unmarshal(b, &title)
+	if title.DefaultValue == nil || title.DefaultValue.Value != "Offer title" {
+		t.Errorf("default value is %+v, want the plain title", title.DefaultValue)
+	}
+	if len(title.TranslatedValues) != 1 || title.TranslatedValues[0].Language != "fr" {
+		t.Errorf("translated values are %+v, want the fr translation", title.TranslatedValues)
+	}
+}
+
+// A Metrics implementation that counts inserts and errors per operation.
+type testMetrics struct {
+	mu      sync.Mutex
+	inserts map[string]int
+	errors  map[string]int
+}
+
+func newTestMetrics() *testMetrics {
+	return &testMetrics{inserts: map[string]int{}, errors: map[string]int{}}
+}
+
+func (m *testMetrics) IncInsert(op string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inserts[op]++
+}
+
+func (m *testMetrics) IncError(op string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.errors[op]++
+}
+
+func (m *testMetrics) ObserveLatency(op string, latency time.Duration) {}
+
+func TestBatchInsertMetrics(t *testing.T) {
+	failBatch := false
+	inserts := batchHandler(t, nil, func(call batchCall) (int, any) {
+		var offerObject walletobjects.OfferObject
+		json.Unmarshal(call.body, &offerObject)
+		if strings.HasSuffix(offerObject.Id, ".taken") {
+			return http.StatusConflict, apiError(http.StatusConflict, "object already exists")
+		}
+		return http.StatusOK, offerObject
+	})
+	d := newTestDemo(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failBatch {
+			http.Error(w, "backend unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		inserts.ServeHTTP(w, r)
+	}))
+	metrics := newTestMetrics()
+	d.metrics = metrics
+
+	var offerObjects []*walletobjects.OfferObject
+	for _, suffix := range []string{"first", "taken", "second"} {
+		offerObjects = append(offerObjects, &walletobjects.OfferObject{
+			Id:      testIssuerId + "." + suffix,
+			ClassId: testIssuerId + ".class",
+			State:   string(StateActive),
+		})
+	}
+	if _, err := d.batchInsertObjects(context.Background(), testIssuerId, offerObjects, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := metrics.inserts["offerobject.insert"]; got != 2 {
+		t.Errorf("counted %d inserts, want 2", got)
+	}
+	if got := metrics.errors["batch"]; got != 0 {
+		t.Errorf("counted %d batch errors, want 0", got)
+	}
+
+	failBatch = true
+	if _, err := d.batchInsertObjects(context.Background(), testIssuerId, offerObjects[:1], nil); err == nil {
+		t.Fatal("got no error for the failed batch request")
+	}
+	if got := metrics.errors["batch"]; got != 1 {
+		t.Errorf("counted %d batch errors, want 1 for the 503 response", got)
+	}
+	if got := metrics.inserts["offerobject.insert"]; got != 2 {
+		t.Errorf("counted %d inserts, want still 2", got)
+	}
+}
+
+func TestParseSigningKey(t *testing.T) {
+	rsaKey, rsaPKCS8 := testRSAKey(t)
+	rsaPKCS1 := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})
+	ecPEM := func(curve elliptic.Curve) []byte {
+		key, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	}
+
+	tests := []struct {
+		name   string
+		pemKey []byte
+		method jwt.SigningMethod
+	}{
+		{"RSA PKCS #8", rsaPKCS8, jwt.SigningMethodRS256},
+		{"RSA PKCS #1", rsaPKCS1, jwt.SigningMethodRS256},
+		{"EC P-256", ecPEM(elliptic.P256()), jwt.SigningMethodES256},
+		{"EC P-384", ecPEM(elliptic.P384()), nil},
+		{"not PEM", []byte("not a key"), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			method, key, err := parseSigningKey(tt.pemKey)
+			if tt.method == nil {
+				if err == nil {
+					t.Fatalf("got signing method %v, want an error", method.Alg())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if method != tt.method {
+				t.Fatalf("got signing method %s, want %s", method.Alg(), tt.method.Alg())
+			}
+			token, err := jwt.NewWithClaims(method, jwt.MapClaims{"iss": testEmail}).SignedString(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			parts := strings.Split(token, ".")
+			var public any
+			switch key := key.(type) {
+			case *rsa.PrivateKey:
+				public = &key.PublicKey
+			case *ecdsa.PrivateKey:
+				public = &key.PublicKey
+			}
+			if err := method.Verify(parts[0]+"."+parts[1], parts[2], public); err != nil {
+				t.Errorf("signature doesn't verify: %v", err)
+			}
+		})
+	}
+}
+
+func TestSaveJWTsRequireRSA(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	d := newTestDemo(t, http.NotFoundHandler())
+	d.credentials.PrivateKey = ecPEM
+	if _, err := d.createJwtExistingObjects(testIssuerId, "class", "object"); err == nil || !strings.Contains(err.Error(), "RS256") {
+		t.Errorf("got error %v for a save link signed with an EC key, want one naming RS256", err)
+	}
+	if _, err := d.estimateJWTSize(map[string]any{}); err == nil {
+		t.Error("got no error estimating a save JWT for an EC key")
+	}
+	if _, err := BuildSaveJWT(testCredentialsJSON(t, map[string]any{"private_key": string(ecPEM)}), map[string]any{}, nil); err == nil {
+		t.Error("got no error building a save JWT with an EC key")
+	}
+
+	// Other tokens can still be signed with the EC key
+	token, err := d.signJWT(jwt.MapClaims{"iss": testEmail})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := jwt.Parse(token, func(t *jwt.Token) (any, error) {
+		return &key.PublicKey, nil
+	})
+	if err != nil || parsed.Method != jwt.SigningMethodES256 {
+		t.Errorf("got %v signed with %v, want a valid ES256 token", err, parsed.Header["alg"])
+	}
+}
+
+func TestNewLinkUriDescriptions(t *testing.T) {
+	uri := newLinkUri("LINK_ID", "https://example.com/", "Store hours", &walletobjects.LocalizedString{
+		DefaultValue: &walletobjects.TranslatedString{Language: "en-US", Value: "Store hours"},
+		TranslatedValues: []*walletobjects.TranslatedString{
+			{Language: "fr", Value: "Heures d'ouverture"},
+		},
+	})
+	b, err := json.Marshal(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sent walletobjects.Uri
+	json.Unmarshal(b, &sent)
+	if sent.Description != "Store hours" {
+		t.Errorf("description is %q, want the plain description", sent.Description)
+	}
+	if sent.LocalizedDescription == nil || len(sent.LocalizedDescription.TranslatedValues) != 1 ||
+		sent.LocalizedDescription.TranslatedValues[0].Value != "Heures d'ouverture" {
+		t.Errorf("localized description is %+v, want the fr translation", sent.LocalizedDescription)
+	}
+
+	b, _ = json.Marshal(newLinkUri("TEL_ID", "tel:6505555555", "Call us", nil))
+	if strings.Contains(string(b), "localizedDescription") {
+		t.Errorf("URI without a translation is %s, want no localizedDescription", b)
+	}
+}
+
+func TestSaveRequestBuilderMixedTypes(t *testing.T) {
+	payload, err := new(SaveRequestBuilder).
+		AddLoyaltyObject(&walletobjects.LoyaltyObject{Id: testIssuerId + ".member", ClassId: testIssuerId + ".program"}).
+		AddOfferObject(&walletobjects.OfferObject{Id: testIssuerId + ".welcome", ClassId: testIssuerId + ".class"}).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, id := range map[string]string{
+		"offerObjects":   testIssuerId + ".welcome",
+		"loyaltyObjects": testIssuerId + ".member",
+	} {
+		entries, ok := payload[key].([]any)
+		if !ok || len(entries) != 1 {
+			t.Errorf("payload %s is %v, want one object", key, payload[key])
+			continue
+		}
+		if got := entries[0].(map[string]any)["id"]; got != id {
+			t.Errorf("payload %s holds %v, want %s", key, got, id)
+		}
+	}
+
+	_, err = new(SaveRequestBuilder).
+		AddLoyaltyObject(&walletobjects.LoyaltyObject{Id: "999.member", ClassId: "999.program"}).
+		AddOfferObject(&walletobjects.OfferObject{Id: testIssuerId + ".welcome", ClassId: testIssuerId + ".class"}).
+		Build()
+	if err == nil {
+		t.Error("got no error for classes of different issuers")
+	}
+}
+
+func TestBatchCreateObjectsMixedResults(t *testing.T) {
+	d := newTestDemo(t, batchHandler(t, nil, func(call batchCall) (int, any) {
+		var offerObject walletobjects.OfferObject
+		json.Unmarshal(call.body, &offerObject)
+		if offerObject.Id == testIssuerId+".taken" {
+			return http.StatusConflict, apiError(http.StatusConflict, "object already exists")
+		}
+		return http.StatusOK, offerObject
+	}))
+
+	var offerObjects []*walletobjects.OfferObject
+	for _, suffix := range []string{"first", "taken", "second"} {
+		offerObjects = append(offerObjects, &walletobjects.OfferObject{
+			Id:      testIssuerId + "." + suffix,
+			ClassId: testIssuerId + ".class",
+			State:   string(StateActive),
+		})
+	}
+	ids, err := d.batchCreateObjectsAcrossClasses(testIssuerId, offerObjects)
+	want := []string{testIssuerId + ".first", testIssuerId + ".second"}
+	if strings.Join(ids, ",") != strings.Join(want, ",") {
+		t.Errorf("got IDs %v, want %v", ids, want)
+	}
+	if !errors.Is(err, ErrObjectExists) {
+		t.Fatalf("got error %v, want ErrObjectExists", err)
+	}
+	if !strings.Contains(err.Error(), testIssuerId+".taken") {
+		t.Errorf("error %q doesn't name the failed object", err)
+	}
+}
+
+func TestUpdateAppLinkPatchesOnlyAppLinkData(t *testing.T) {
+	var patch map[string]any
+	d := newTestDemo(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPatch || r.URL.Path != "/walletobjects/v1/offerObject/"+testIssuerId+".object" {
+			t.Errorf("unexpected %s %s request", r.Method, r.URL.Path)
+		}
+		json.NewDecoder(r.Body).Decode(&patch)
+		writeJSON(w, http.StatusOK, walletobjects.OfferObject{Id: testIssuerId + ".object"})
+	}))
+	if err := d.updateAppLink(testIssuerId, "object", "", "", "https://example.com/app", nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(patch) != 1 || patch["appLinkData"] == nil {
+		t.Fatalf("patch is %v, want only appLinkData", patch)
+	}
+	b, _ := json.Marshal(patch["appLinkData"])
+	var appLinkData walletobjects.AppLinkData
+	json.Unmarshal(b, &appLinkData)
+	if appLinkData.AndroidAppLinkInfo != nil || appLinkData.IosAppLinkInfo != nil {
+		t.Errorf("app link data is %s, want only the web link", b)
+	}
+	if appLinkData.WebAppLinkInfo == nil || appLinkData.WebAppLinkInfo.AppTarget.TargetUri.Uri != "https://example.com/app" {
+		t.Errorf("app link data is %s, want the web link", b)
+	}
+
+	if err := d.updateAppLink(testIssuerId, "object", "", "", "", nil); err == nil {
+		t.Error("got no error without any link")
+	}
+}
+
+func TestCreateObjectValidTimeInterval(t *testing.T) {
+	var inserted map[string]any
+	d := newTestDemo(t, insertHandler(t, &inserted))
+
+	// The offer's narrower window, e.g. a weekend sale within a season
+	validity := &walletobjects.TimeInterval{
+		Start: &walletobjects.DateTime{Date: "2023-07-01T00:00:00Z"},
+		End:   &walletobjects.DateTime{Date: "2023-07-03T00:00:00Z"},
+	}
+	config := &OfferObjectConfig{State: StateActive, ValidTimeInterval: validity}
+	if _, err := d.createObject(testIssuerId, "class", "object", config); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := json.Marshal(inserted["validTimeInterval"])
+	var sent walletobjects.TimeInterval
+	json.Unmarshal(b, &sent)
+	if sent.Start == nil || sent.Start.Date != validity.Start.Date || sent.End == nil || sent.End.Date != validity.End.Date {
+		t.Errorf("validTimeInterval is %s, want %s to %s", b, validity.Start.Date, validity.End.Date)
+	}
+
+	// Without one the object has no window of its own
+	if _, err := d.createObject(testIssuerId, "class", "object2", &OfferObjectConfig{State: StateActive}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := inserted["validTimeInterval"]; ok {
+		t.Errorf("object without validity has validTimeInterval %v", inserted["validTimeInterval"])
+	}
+}
+
+func TestOfferObjectConfigSparse(t *testing.T) {
+	// The state is the only field the API requires
+	config := &OfferObjectConfig{State: StateActive, BarcodeValue: "SAVE10"}
+	offerObject, err := config.offerObject(testIssuerId+".object", testIssuerId+".class")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(offerObject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sent map[string]any
+	json.Unmarshal(b, &sent)
+	want := []string{"barcode", "classId", "id", "state"}
+	var got []string
+	for name := range sent {
+		got = append(got, name)
+	}
+	sort.Strings(got)
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("object has fields %v, want only %v", got, want)
+	}
+	if barcode, _ := sent["barcode"].(map[string]any); barcode["type"] != string(BarcodeQrCode) || barcode["value"] != "SAVE10" {
+		t.Errorf("barcode is %v, want a QR code with value SAVE10", sent["barcode"])
+	}
+}
+
+func TestCreateObjectLinkedObjectIds(t *testing.T) {
+	var inserted map[string]any
+	d := newTestDemo(t, insertHandler(t, &inserted))
+
+	linked := []string{testIssuerId + ".loyalty", testIssuerId + ".coupon"}
+	config := &OfferObjectConfig{State: StateActive, LinkedObjectIds: linked}
+	if _, err := d.createObject(testIssuerId, "class", "object", config); err != nil {
+		t.Fatal(err)
+	}
+	ids, _ := inserted["linkedObjectIds"].([]any)
+	if len(ids) != len(linked) || ids[0] != linked[0] || ids[1] != linked[1] {
+		t.Errorf("linkedObjectIds is %v, want %v", inserted["linkedObjectIds"], linked)
+	}
+
+	config.LinkedObjectIds = []string{"not an object ID"}
+	if _, err := d.createObject(testIssuerId, "class", "object", config); err == nil {
+		t.Error("got no error for a malformed linked object ID")
+	}
+}
+
+func TestAddClassMessageNotify(t *testing.T) {
+	tests := []struct {
+		notify      bool
+		messageType string
+	}{
+		{false, "TEXT"},
+		{true, "TEXT_AND_NOTIFY"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.messageType, func(t *testing.T) {
+			var request walletobjects.AddMessageRequest
+			d := newTestDemo(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodPost || r.URL.Path != "/walletobjects/v1/offerClass/"+testIssuerId+".class/addMessage" {
+					t.Errorf("unexpected %s %s request", r.Method, r.URL.Path)
+				}
+				json.NewDecoder(r.Body).Decode(&request)
+				writeJSON(w, http.StatusOK, walletobjects.OfferClassAddMessageResponse{})
+			}))
+			// The caller's messageType is replaced either way
+			message := &walletobjects.Message{Header: "Sale", Body: "20% off today", MessageType: "EXPIRATION_NOTIFICATION"}
+			if err := d.addClassMessage(testIssuerId, "class", message, tt.notify); err != nil {
+				t.Fatal(err)
+			}
+			if request.Message == nil || request.Message.MessageType != tt.messageType || request.Message.Body != "20% off today" {
+				t.Errorf("message is %+v, want %s with the given body", request.Message, tt.messageType)
+			}
+			if message.MessageType != "EXPIRATION_NOTIFICATION" {
+				t.Errorf("caller's message type changed to %s", message.MessageType)
+			}
+		})
+	}
+}
+
+func TestUpdateBarcodeValuePatchesOnlyBarcode(t *testing.T) {
+	var patch map[string]any
+	d := newTestDemo(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, walletobjects.OfferObject{
+				Id:      testIssuerId + ".object",
+				ClassId: testIssuerId + ".class",
+				State:   string(StateActive),
+				Barcode: &walletobjects.Barcode{
+					Type:          string(BarcodeCode128),
+					Value:         "OLDCODE",
+					AlternateText: "Coupon code",
+				},
+			})
+		case http.MethodPatch:
+			json.NewDecoder(r.Body).Decode(&patch)
+			writeJSON(w, http.StatusOK, walletobjects.OfferObject{Id: testIssuerId + ".object"})
+		default:
+			t.Errorf("unexpected %s request", r.Method)
+		}
+	}))
+	if err := d.updateBarcodeValue(testIssuerId, "object", "NEWCODE"); err != nil {
+		t.Fatal(err)
+	}
+	if len(patch) != 1 || patch["barcode"] == nil {
+		t.Fatalf("patch is %v, want only barcode", patch)
+	}
+	barcode := patch["barcode"].(map[string]any)
+	if barcode["value"] != "NEWCODE" || barcode["type"] != string(BarcodeCode128) || barcode["alternateText"] != "Coupon code" {
+		t.Errorf("barcode is %v, want the new value with the type and alternate text kept", barcode)
+	}
+
+	if err := d.updateBarcodeValue(testIssuerId, "object", ""); err == nil {
+		t.Error("got no error for an empty barcode value")
+	}
+}
+
+func TestSaveLinkHTML(t *testing.T) {
+	d := newTestDemo(t, http.NotFoundHandler())
+	page, err := d.saveLinkHTML(map[string]any{
+		"offerObjects": []any{map[string]any{"id": testIssuerId + ".object", "classId": testIssuerId + ".class"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := html.Parse(strings.NewReader(page))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attrs := func(n *html.Node) map[string]string {
+		m := make(map[string]string)
+		for _, a := range n.Attr {
+			m[a.Key] = a.Val
+		}
+		return m
+	}
+	var action, token string
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			switch a := attrs(n); n.Data {
+			case "form":
+				action = a["action"]
+			case "input":
+				if a["name"] == "jwt" {
+					token = a["value"]
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+
+	if action != saveFormUrl {
+		t.Errorf("form posts to %q, want %q", action, saveFormUrl)
+	}
+	if token == "" {
+		t.Fatal("page has no jwt input")
+	}
+	claims := parseTestJWT(t, token)
+	if claims["iss"] != testEmail {
+		t.Errorf("token issuer is %v, want %s", claims["iss"], testEmail)
+	}
+}
+
+func TestNewCredentialsServiceAccountOnly(t *testing.T) {
+	// As written by "gcloud auth application-default login"
+	userCredentials := []byte(`{
+		"type": "authorized_user",
+		"client_id": "1.apps.googleusercontent.com",
+		"client_secret": "secret",
+		"refresh_token": "token"
+	}`)
+	tests := []struct {
+		name string
+		b    []byte
+		want string
+	}{
+		{"user credentials", userCredentials, `type "authorized_user"`},
+		{"not JSON", []byte("client_email=demo"), "not valid JSON"},
+		{"no client_email", testCredentialsJSON(t, map[string]any{"client_email": nil}), "no client_email"},
+		{"other token_uri", testCredentialsJSON(t, map[string]any{"token_uri": "https://example.com/token"}), "token_uri"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := newCredentials(tt.b, nil, "test", nil)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %v, want one mentioning %s", err, tt.want)
+			}
+		})
+	}
+
+	credentials, _, err := newCredentials(testCredentialsJSON(t, nil), nil, "test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if credentials.Email != testEmail {
+		t.Errorf("got email %s, want %s", credentials.Email, testEmail)
+	}
+}
+
+func TestSignJWTWithJWK(t *testing.T) {
+	key, _ := testRSAKey(t)
+	member := func(n *big.Int) string {
+		return base64.RawURLEncoding.EncodeToString(n.Bytes())
+	}
+	jwk := map[string]string{
+		"kty": "RSA",
+		"n":   member(key.N),
+		"e":   member(big.NewInt(int64(key.E))),
+		"d":   member(key.D),
+		"p":   member(key.Primes[0]),
+		"q":   member(key.Primes[1]),
+	}
+	jwkJSON, _ := json.Marshal(jwk)
+
+	parsed, err := parseRSAPrivateJWK(jwkJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !parsed.Equal(key) {
+		t.Fatal("JWK parses to a different key than the PEM")
+	}
+
+	d := newTestDemo(t, http.NotFoundHandler())
+	d.jwtTtl = time.Hour
+	now := time.Now()
+	d.now = func() time.Time { return now }
+	payload := map[string]any{
+		"offerObjects": []any{map[string]any{"id": testIssuerId + ".object"}},
+	}
+	jwkToken, err := d.signJWTWithJWK(jwkJSON, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemToken, err := d.signClaims(d.saveClaims(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	parseTestJWT(t, jwkToken)
+	// RS256 signatures are deterministic, so the same key and claims give
+	// the same token
+	if jwkToken != pemToken {
+		t.Error("JWK and PEM forms of the key sign different tokens")
+	}
+
+	delete(jwk, "d")
+	publicOnly, _ := json.Marshal(jwk)
+	if _, err := d.signJWTWithJWK(publicOnly, payload); err == nil {
+		t.Error("got no error for a public JWK")
+	}
+}
+
+func TestBuildSaveJWT(t *testing.T) {
+	payload := map[string]any{
+		"offerObjects": []any{map[string]any{"id": testIssuerId + ".object", "classId": testIssuerId + ".class"}},
+	}
+	token, err := BuildSaveJWT(testCredentialsJSON(t, nil), payload, []string{"www.example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := parseTestJWT(t, token)
+	if claims["iss"] != testEmail || claims["aud"] != "google" || claims["typ"] != "savetowallet" {
+		t.Errorf("claims are %v, want a save JWT issued by %s", claims, testEmail)
+	}
+	if origins, _ := claims["origins"].([]any); len(origins) != 1 || origins[0] != "www.example.com" {
+		t.Errorf("origins are %v, want [www.example.com]", claims["origins"])
+	}
+	b, _ := json.Marshal(claims["payload"])
+	if !strings.Contains(string(b), testIssuerId+".object") {
+		t.Errorf("payload is %s, want the object", b)
+	}
+
+	_, err = BuildSaveJWT(testCredentialsJSON(t, map[string]any{"type": "authorized_user"}), payload, nil)
+	if err == nil {
+		t.Error("got no error for user credentials")
+	}
+}
+
+func TestProxyImages(t *testing.T) {
+	d := &demoOffer{imageProxy: "https://proxy.example.com/fetch?url="}
+	hero := newImage("https://cdn.example.com/a.png", "Banner")
+	original := hero
+	var missing *walletobjects.Image
+	if err := d.proxyImages(&hero, &missing); err != nil {
+		t.Fatal(err)
+	}
+	want := "https://proxy.example.com/fetch?url=https%3A%2F%2Fcdn.example.com%2Fa.png"
+	if hero.SourceUri.Uri != want {
+		t.Errorf("got URI %s, want %s", hero.SourceUri.Uri, want)
+	}
+	if hero.ContentDescription != original.ContentDescription {
+		t.Error("content description wasn't kept")
+	}
+	if original.SourceUri.Uri != "https://cdn.example.com/a.png" {
+		t.Errorf("original image changed to %s", original.SourceUri.Uri)
+	}
+	if missing != nil {
+		t.Error("nil image was replaced")
+	}
+
+	for _, proxy := range []string{"http://proxy.example.com/?url=", "/fetch?url=", "https://"} {
+		d := &demoOffer{imageProxy: proxy}
+		image := newImage("https://cdn.example.com/a.png", "")
+		if err := d.proxyImages(&image); err == nil {
+			t.Errorf("got no error for image proxy %q", proxy)
+		}
+	}
+}
+
+func TestCreateObjectExtraFields(t *testing.T) {
+	var inserted map[string]any
+	d := newTestDemo(t, insertHandler(t, &inserted))
+
+	config := &OfferObjectConfig{
+		State: StateActive,
+		ExtraFields: map[string]any{
+			"newApiField": map[string]any{"enabled": true},
+			// Replaces the state from the config
+			"state": "INACTIVE",
+		},
+	}
+	if _, err := d.createObject(testIssuerId, "class", "object", config); err != nil {
+		t.Fatal(err)
+	}
+	if field, _ := inserted["newApiField"].(map[string]any); field["enabled"] != true {
+		t.Errorf("newApiField is %v, want the extra field", inserted["newApiField"])
+	}
+	if inserted["state"] != "INACTIVE" {
+		t.Errorf("state is %v, want the extra field's INACTIVE", inserted["state"])
+	}
+	if inserted["id"] != testIssuerId+".object" || inserted["classId"] != testIssuerId+".class" {
+		t.Errorf("object is %v, want its ID and class ID kept", inserted)
+	}
+}
+
+func TestAuthMissingCredentials(t *testing.T) {
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "")
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS_JSON", "")
+	d := new(demoOffer)
+	if err := d.auth(); !errors.Is(err, ErrMissingCredentials) {
+		t.Errorf("got error %v, want ErrMissingCredentials", err)
+	}
+	if d.svc() != nil {
+		t.Error("service was set without credentials")
+	}
+
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS_JSON", string(testCredentialsJSON(t, nil)))
+	if err := d.auth(); err != nil {
+		t.Fatalf("auth from GOOGLE_APPLICATION_CREDENTIALS_JSON: %v", err)
+	}
+	if d.creds().Email != testEmail {
+		t.Errorf("got email %s, want %s", d.creds().Email, testEmail)
+	}
+}
+
+// A rotated key file replaces the credentials and service of a demoOffer
+// that is in use.
+func TestWatchCredentials(t *testing.T) {
+	defer func(interval time.Duration) { credentialsPollInterval = interval }(credentialsPollInterval)
+	credentialsPollInterval = time.Millisecond
+
+	path := filepath.Join(t.TempDir(), "key.json")
+	if err := os.WriteFile(path, testCredentialsJSON(t, nil), 0600); err != nil {
+		t.Fatal(err)
+	}
+	d := &demoOffer{}
+	credentials, service, err := loadCredentials(path, nil, d.agent(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.credentials, d.service = credentials, service
+	errs, stop := d.WatchCredentials(path)
+	defer stop()
+
+	// Replace the file in one step, as a rotated secret is, so the watcher
+	// never reads half of it
+	const rotatedEmail = "rotated@example.iam.gserviceaccount.com"
+	rotated := path + ".new"
+	if err := os.WriteFile(rotated, testCredentialsJSON(t, map[string]any{"client_email": rotatedEmail}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(rotated, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(rotated, path); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.After(5 * time.Second)
+	for d.creds().Email != rotatedEmail {
+		select {
+		case err := <-errs:
+			t.Fatalf("watcher reported %v", err)
+		case <-deadline:
+			t.Fatalf("credentials are still for %s after the file changed", d.creds().Email)
+		case <-time.After(time.Millisecond):
+		}
+	}
+	if d.svc() == service {
+		t.Error("service wasn't replaced with the credentials")
+	}
+
+	// The watcher closes errs when it returns
+	stop()
+	for {
+		select {
+		case _, ok := <-errs:
+			if !ok {
+				stop()
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("watcher didn't stop")
+		}
+	}
+}
+
+func TestCreateClassBackgroundColor(t *testing.T) {
+	tests := []struct {
+		color string
+		want  string
+	}{
+		{"navy", "#000080"},
+		{" Red ", "#ff0000"},
+		{"#1A2b3C", "#1A2b3C"},
+		{"bluish", ""},
+		{"#12345", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.color, func(t *testing.T) {
+			var inserted walletobjects.OfferClass
+			d := newTestDemo(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodPost || r.URL.Path != "/walletobjects/v1/offerClass" {
+					t.Errorf("unexpected %s %s request", r.Method, r.URL.Path)
+				}
+				json.NewDecoder(r.Body).Decode(&inserted)
+				writeJSON(w, http.StatusOK, inserted)
+			}))
+			config := demoOfferClassConfig()
+			config.BackgroundColor = tt.color
+			_, err := d.createClass(testIssuerId, "class", config)
+			if tt.want == "" {
+				if err == nil || !strings.Contains(err.Error(), "unknown color") {
+					t.Errorf("got error %v, want an unknown color error", err)
+				}
+				if inserted.Id != "" {
+					t.Error("class with an unknown color was inserted")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if inserted.HexBackgroundColor != tt.want {
+				t.Errorf("hexBackgroundColor is %q, want %q", inserted.HexBackgroundColor, tt.want)
+			}
+		})
+	}
+}
+
+// Terminals can't read a smart tap pass without a redemption issuer, so
+// the class is rejected before it's sent.
+func TestCreateClassSmartTapWithoutRedemptionIssuers(t *testing.T) {
+	d := newTestDemo(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected %s %s request", r.Method, r.URL.Path)
+	}))
+	config := demoOfferClassConfig()
+	config.EnableSmartTap = true
+	config.RedemptionIssuers = []int64{}
+	_, err := d.createClass(testIssuerId, "class", config)
+	if err == nil || !strings.Contains(err.Error(), "enables smart tap but has no redemptionIssuers") {
+		t.Errorf("got error %v, want a missing redemptionIssuers error", err)
+	}
+}
+
+func TestCreateObjectInvalidState(t *testing.T) {
+	d := newTestDemo(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Errorf("unexpected %s %s request", r.Method, r.URL.Path)
+	}))
+	config := demoOfferObjectConfig()
+	config.State = ObjectState("EXPIRE")
+	_, err := d.createObject(testIssuerId, "class", "object", config)
+	if err == nil || !strings.Contains(err.Error(), `invalid object state "EXPIRE"`) {
+		t.Errorf("got error %v, want an invalid object state error", err)
+	}
+}
+
+func TestAddLocalizedObjectMessage(t *testing.T) {
+	var request walletobjects.AddMessageRequest
+	d := newTestDemo(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/walletobjects/v1/offerObject/"+testIssuerId+".object/addMessage" {
+			t.Errorf("unexpected %s %s request", r.Method, r.URL.Path)
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+		writeJSON(w, http.StatusOK, walletobjects.OfferObjectAddMessageResponse{})
+	}))
+	localized := func(en, es string) *walletobjects.LocalizedString {
+		return &walletobjects.LocalizedString{
+			DefaultValue:     &walletobjects.TranslatedString{Language: "en-US", Value: en},
+			TranslatedValues: []*walletobjects.TranslatedString{{Language: "es", Value: es}},
+		}
+	}
+	err := d.addLocalizedObjectMessage(testIssuerId, "object", localized("Topped up", "Recargado"), localized("Your coupon is worth $5 more", "Tu cupón vale $5 más"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := request.Message
+	if message == nil || message.LocalizedHeader == nil || message.LocalizedBody == nil {
+		t.Fatalf("message is %+v, want a localized header and body", message)
+	}
+	if got := message.LocalizedHeader.TranslatedValues; len(got) != 1 || got[0].Value != "Recargado" {
+		t.Errorf("localized header has %+v, want the es translation", got)
+	}
+	if got := message.LocalizedBody.TranslatedValues; len(got) != 1 || got[0].Value != "Tu cupón vale $5 más" {
+		t.Errorf("localized body has %+v, want the es translation", got)
+	}
+	if message.Header != "Topped up" || message.Body != "Your coupon is worth $5 more" {
+		t.Errorf("plain header and body are %q, %q, want the default values", message.Header, message.Body)
+	}
+
+	noDefault := &walletobjects.LocalizedString{TranslatedValues: localized("", "Recargado").TranslatedValues}
+	if err := d.addLocalizedObjectMessage(testIssuerId, "object", noDefault, localized("Body", "Cuerpo"), false); err == nil {
+		t.Error("got no error for a header without a default value")
+	}
+}
+
+func TestCreateObjectRetriesInsertOnlyIfNotCreated(t *testing.T) {
+	defer func(delay time.Duration) { retryDelay = delay }(retryDelay)
+	retryDelay = time.Millisecond
+
+	tests := []struct {
+		name string
+		// Whether the insert that failed with a 503 still created the object
+		created bool
+		inserts int
+	}{
+		{"timeout but actually created", true, 1},
+		{"not created", false, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inserts := 0
+			var stored *walletobjects.OfferObject
+			d := newTestDemo(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.Method {
+				case http.MethodPost:
+					inserts++
+					var offerObject walletobjects.OfferObject
+					json.NewDecoder(r.Body).Decode(&offerObject)
+					if inserts == 1 {
+						if tt.created {
+							stored = &offerObject
+						}
+						writeJSON(w, http.StatusServiceUnavailable, apiError(http.StatusServiceUnavailable, "backend unavailable"))
+						return
+					}
+					stored = &offerObject
+					writeJSON(w, http.StatusOK, offerObject)
+				case http.MethodGet:
+					if stored == nil {
+						writeJSON(w, http.StatusNotFound, apiError(http.StatusNotFound, "object not found"))
+						return
+					}
+					writeJSON(w, http.StatusOK, stored)
+				}
+			}))
+			res, err := d.createObject(testIssuerId, "class", "object", &OfferObjectConfig{State: StateActive})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.ID != testIssuerId+".object" {
+				t.Errorf("got ID %s, want %s.object", res.ID, testIssuerId)
+			}
+			if inserts != tt.inserts {
+				t.Errorf("object was inserted %d times, want %d", inserts, tt.inserts)
+			}
+		})
+	}
+}
+
+func TestExpireStaleObjectsPartialFailure(t *testing.T) {
+	object := func(suffix, state, end string) *walletobjects.OfferObject {
+		return &walletobjects.OfferObject{
+			Id:      testIssuerId + "." + suffix,
+			ClassId: testIssuerId + ".class",
+			State:   state,
+			ValidTimeInterval: &walletobjects.TimeInterval{
+				End: &walletobjects.DateTime{Date: end},
+			},
+		}
+	}
+	// Two pages, so the failure doesn't stop the next page being listed
+	pages := map[string]walletobjects.OfferObjectListResponse{
+		"": {
+			Resources: []*walletobjects.OfferObject{
+				object("stale1", "ACTIVE", "2023-01-01T00:00:00Z"),
+				object("broken", "ACTIVE", "2023-01-01T00:00:00Z"),
+				object("current", "ACTIVE", "2024-01-01T00:00:00Z"),
+			},
+			Pagination: &walletobjects.Pagination{NextPageToken: "page2"},
+		},
+		"page2": {
+			Resources: []*walletobjects.OfferObject{
+				object("done", "EXPIRED", "2023-01-01T00:00:00Z"),
+				object("stale2", "ACTIVE", "2023-01-01T00:00:00Z"),
+			},
+		},
+	}
+	var patched []string
+	d := newTestDemo(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			if r.URL.Query().Get("classId") != testIssuerId+".class" {
+				t.Errorf("listed objects of class %q", r.URL.Query().Get("classId"))
+			}
+			writeJSON(w, http.StatusOK, pages[r.URL.Query().Get("token")])
+		case http.MethodPatch:
+			id := strings.TrimPrefix(r.URL.Path, "/walletobjects/v1/offerObject/")
+			var patch map[string]any
+			json.NewDecoder(r.Body).Decode(&patch)
+			if patch["state"] != string(StateExpired) {
+				t.Errorf("patch of %s is %v, want state EXPIRED", id, patch)
+			}
+			patched = append(patched, id)
+			if id == testIssuerId+".broken" {
+				writeJSON(w, http.StatusInternalServerError, apiError(http.StatusInternalServerError, "internal error"))
+				return
+			}
+			writeJSON(w, http.StatusOK, walletobjects.OfferObject{Id: id})
+		}
+	}))
+
+	now := time.Date(2023, 6, 1, 0, 0, 0, 0, time.UTC)
+	expired, err := d.expireStaleObjects(context.Background(), testIssuerId, "class", now)
+	want := []string{testIssuerId + ".stale1", testIssuerId + ".stale2"}
+	if strings.Join(expired, ",") != strings.Join(want, ",") {
+		t.Errorf("expired %v, want %v", expired, want)
+	}
+	if len(patched) != 3 {
+		t.Errorf("patched %v, want the two stale objects and the broken one", patched)
+	}
+	if err == nil || !strings.Contains(err.Error(), testIssuerId+".broken") {
+		t.Fatalf("got error %v, want one naming %s.broken", err, testIssuerId)
+	}
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) || apiErr.Code != http.StatusInternalServerError {
+		t.Errorf("error %v doesn't wrap the 500 response", err)
+	}
+}
+
+func TestSaveClaimsFixedClock(t *testing.T) {
+	d := newTestDemo(t, http.NotFoundHandler())
+	now := time.Date(2023, 6, 12, 23, 20, 50, 0, time.UTC)
+	d.now = func() time.Time { return now }
+
+	tests := []struct {
+		ttl      time.Duration
+		iat, exp any
+	}{
+		{0, nil, nil},
+		{time.Hour, float64(now.Unix()), float64(now.Add(time.Hour).Unix())},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ttl.String(), func(t *testing.T) {
+			d.jwtTtl = tt.ttl
+			first, err := d.createJwtExistingObjects(testIssuerId, "class", "object")
+			if err != nil {
+				t.Fatal(err)
+			}
+			second, err := d.createJwtExistingObjects(testIssuerId, "class", "object")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if first.URL != second.URL {
+				t.Error("the same clock gave different save links")
+			}
+
+			// Signed in the past, so only the signature is checked
+			token := strings.TrimPrefix(first.URL, saveUrlPrefix)
+			parser := &jwt.Parser{SkipClaimsValidation: true}
+			claims := jwt.MapClaims{}
+			_, err = parser.ParseWithClaims(token, claims, func(token *jwt.Token) (any, error) {
+				key, _ := testRSAKey(t)
+				return &key.PublicKey, nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if claims["iat"] != tt.iat || claims["exp"] != tt.exp {
+				t.Errorf("iat and exp are %v and %v, want %v and %v", claims["iat"], claims["exp"], tt.iat, tt.exp)
+			}
+		})
+	}
+}
+
+func TestNewBarcodeLengthLimits(t *testing.T) {
+	for barcodeType, limit := range maxBarcodeLength {
+		t.Run(string(barcodeType), func(t *testing.T) {
+			if _, err := newBarcode(barcodeType, strings.Repeat("1", limit), "", nil); err != nil {
+				t.Errorf("value of %d digits: %v", limit, err)
+			}
+			if _, err := newBarcode(barcodeType, strings.Repeat("1", limit+1), "", nil); err == nil {
+				t.Errorf("got no error for a value of %d digits", limit+1)
+			}
+		})
+	}
+
+	_, err := newBarcode(BarcodeCode128, strings.Repeat("A", 81), "", nil)
+	if err == nil || !strings.Contains(err.Error(), "over the limit of 80") {
+		t.Errorf("got error %v for an 81 character CODE_128 value, want one naming the limit", err)
+	}
+}
+
+func TestValidateServiceAccount(t *testing.T) {
+	_, keyPEM := testRSAKey(t)
+	tests := []struct {
+		name     string
+		email    string
+		key      []byte
+		tokenUrl string
+		valid    bool
+	}{
+		{"service account", testEmail, keyPEM, "https://oauth2.googleapis.com/token", true},
+		{"older token endpoint", testEmail, keyPEM, "https://accounts.google.com/o/oauth2/token", true},
+		{"no email", "", keyPEM, "https://oauth2.googleapis.com/token", false},
+		{"no key", testEmail, nil, "https://oauth2.googleapis.com/token", false},
+		{"plain http", testEmail, keyPEM, "http://oauth2.googleapis.com/token", false},
+		{"other host", testEmail, keyPEM, "https://oauth2.example.com/token", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateServiceAccount(&oauthJwt.Config{Email: tt.email, PrivateKey: tt.key, TokenURL: tt.tokenUrl})
+			if (err == nil) != tt.valid {
+				t.Errorf("got error %v, want valid %v", err, tt.valid)
+			}
+		})
+	}
+}
+
+// Inserts are counted when they succeed, and every failed call as an
+// error.
+func TestMetrics(t *testing.T) {
+	insertStatus := http.StatusOK
+	d := newTestDemo(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, walletobjects.OfferClass{Id: testIssuerId + ".source"})
+		case http.MethodPost:
+			var offerClass walletobjects.OfferClass
+			json.NewDecoder(r.Body).Decode(&offerClass)
+			writeJSON(w, insertStatus, offerClass)
+		default:
+			t.Errorf("unexpected %s %s request", r.Method, r.URL.Path)
+		}
+	}))
+	metrics := newTestMetrics()
+	d.metrics = metrics
+
+	if _, err := d.cloneClass(testIssuerId, "source", "copy"); err != nil {
+		t.Fatal(err)
+	}
+	if got := metrics.inserts["offerclass.insert"]; got != 1 {
+		t.Errorf("counted %d inserts, want 1", got)
+	}
+	if len(metrics.errors) != 0 {
+		t.Errorf("counted errors %v, want none", metrics.errors)
+	}
+
+	insertStatus = http.StatusConflict
+	if _, err := d.cloneClass(testIssuerId, "source", "copy"); err == nil {
+		t.Fatal("got no error for the failed insert")
+	}
+	if got := metrics.inserts["offerclass.insert"]; got != 1 {
+		t.Errorf("counted %d inserts, want the failed one left out", got)
+	}
+	if got := metrics.errors["offerclass.insert"]; got != 1 {
+		t.Errorf("counted %d insert errors, want 1", got)
+	}
+	if got := metrics.errors["offerclass.get"]; got != 0 {
+		t.Errorf("counted %d get errors, want 0", got)
+	}
+}
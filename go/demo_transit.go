@@ -1,3 +1,5 @@
+//go:build transit
+
 /*
  * Copyright 2023 Google Inc.
  *
@@ -28,12 +30,14 @@ import (
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	oauthJwt "golang.org/x/oauth2/jwt"
+	"golang.org/x/text/language"
 	"google.golang.org/api/option"
 	"google.golang.org/api/walletobjects/v1"
 	"io"
 	"log"
 	"os"
 	"strings"
+	"time"
 )
 
 // [END imports]
@@ -74,6 +78,21 @@ func (d *demoTransit) createClass(issuerId, classSuffix string) {
 	transitClass.ReviewStatus = "UNDER_REVIEW"
 	transitClass.Logo = &logo
 	transitClass.TransitType = "BUS"
+
+	// The country is shown to users outside it, and its language is used
+	// for content that isn't translated into the user's language
+	transitClass.CountryCode = "US"
+	if err := validateCountryCode(transitClass.CountryCode); err != nil {
+		log.Fatalf("Invalid class: %v", err)
+	}
+	// Tickets are normally shown in the language of the user's device.
+	// Set languageOverride only for a single-market service whose tickets
+	// must match the signage and staff, e.g. for ticket inspection.
+	transitClass.LanguageOverride = "en-US"
+	if err := validateLanguageTag(transitClass.LanguageOverride); err != nil {
+		log.Fatalf("Invalid class: %v", err)
+	}
+
 	res, err := d.service.Transitclass.Insert(transitClass).Do()
 	if err != nil {
 		log.Fatalf("Unable to insert class: %v", err)
@@ -84,6 +103,23 @@ func (d *demoTransit) createClass(issuerId, classSuffix string) {
 
 // [END createClass]
 
+// Check that a country code is an ISO 3166-1 alpha-2 code, e.g. "US".
+func validateCountryCode(countryCode string) error {
+	region, err := language.ParseRegion(countryCode)
+	if err != nil || len(countryCode) != 2 || !region.IsCountry() {
+		return fmt.Errorf("country code %q is not an ISO 3166-1 alpha-2 code", countryCode)
+	}
+	return nil
+}
+
+// Check that a language is a valid BCP 47 tag, e.g. "en-US".
+func validateLanguageTag(tag string) error {
+	if _, err := language.Parse(tag); err != nil {
+		return fmt.Errorf("language %q is not a valid BCP 47 tag: %w", tag, err)
+	}
+	return nil
+}
+
 // [START createObject]
 // Create an object.
 func (d *demoTransit) createObject(issuerId, classSuffix, objectSuffix string) {
@@ -94,6 +130,15 @@ func (d *demoTransit) createObject(issuerId, classSuffix, objectSuffix string) {
 	transitObject.PassengerNames = "Passenger names"
 	transitObject.TripType = "ONE_WAY"
 	transitObject.PassengerType = "SINGLE_PASSENGER"
+	// Tickets with the same trip ID are grouped together in the wallet,
+	// e.g. the tickets of a family travelling together
+	transitObject.TripId = "TRIP_ID"
+	// The fare the passenger travels on; passengerType is only whether the
+	// ticket is for one passenger or several
+	transitObject.ConcessionCategory = "ADULT"
+	if err := validateTicketEnums(transitObject); err != nil {
+		log.Fatalf("Invalid object: %v", err)
+	}
 	transitObject.TicketLeg = &walletobjects.TicketLeg{
 		DestinationStationCode: "SFO",
 		OriginStationCode:      "LA",
@@ -107,6 +152,14 @@ func (d *demoTransit) createObject(issuerId, classSuffix, objectSuffix string) {
 		Type:  "QR_CODE",
 		Value: "QR code",
 	}
+	// Keep other NFC credentials from being read at the fare gate while the
+	// pass is open. A closed-loop ticket, read by the agency's own gates,
+	// should block payment cards with BLOCK_PAYMENT. Use
+	// BLOCK_CLOSED_LOOP_TRANSIT instead to keep the agency's closed-loop
+	// cards from being read in place of this pass.
+	transitObject.PassConstraints = &walletobjects.PassConstraints{
+		NfcConstraint: []string{"BLOCK_PAYMENT"},
+	}
 	transitObject.Locations = []*walletobjects.LatLongPoint{
 		&walletobjects.LatLongPoint{
 			Latitude:  37.424015499999996,
@@ -154,6 +207,134 @@ func (d *demoTransit) createObject(issuerId, classSuffix, objectSuffix string) {
 
 // [END createObject]
 
+// [START multiLeg]
+// Create an object for a connecting journey, with a ticket leg for each
+// train.
+//
+// Use ticketLegs instead of ticketLeg when the ticket covers more than one
+// leg. The legs must be in the order they are travelled.
+func (d *demoTransit) createConnectingObject(issuerId, classSuffix, objectSuffix string) {
+	transitObject := new(walletobjects.TransitObject)
+	transitObject.Id = fmt.Sprintf("%s.%s", issuerId, objectSuffix)
+	transitObject.ClassId = fmt.Sprintf("%s.%s", issuerId, classSuffix)
+	transitObject.State = "ACTIVE"
+	transitObject.PassengerNames = "Passenger names"
+	transitObject.TripType = "ONE_WAY"
+	transitObject.PassengerType = "SINGLE_PASSENGER"
+	transitObject.TicketLegs = []*walletobjects.TicketLeg{
+		&walletobjects.TicketLeg{
+			OriginStationCode:      "LA",
+			DestinationStationCode: "SJ",
+			DepartureDateTime:      "2023-06-12T08:00:00",
+			ArrivalDateTime:        "2023-06-12T14:30:00",
+		},
+		&walletobjects.TicketLeg{
+			OriginStationCode:      "SJ",
+			DestinationStationCode: "SFO",
+			DepartureDateTime:      "2023-06-12T15:10:00",
+			ArrivalDateTime:        "2023-06-12T16:20:00",
+		},
+	}
+	transitObject.Barcode = &walletobjects.Barcode{
+		Type:  "QR_CODE",
+		Value: "QR code",
+	}
+	if err := validateTicketLegs(transitObject.TicketLegs); err != nil {
+		log.Fatalf("Invalid object: %v", err)
+	}
+
+	res, err := d.service.Transitobject.Insert(transitObject).Do()
+	if err != nil {
+		log.Fatalf("Unable to insert object: %v", err)
+	} else {
+		fmt.Printf("Object insert id:\n%s\n", res.Id)
+	}
+}
+
+// Values of the transit object fields checked by validateTicketEnums.
+var (
+	passengerTypes       = []string{"SINGLE_PASSENGER", "MULTIPLE_PASSENGERS"}
+	concessionCategories = []string{"ADULT", "CHILD", "SENIOR"}
+	ticketStatuses       = []string{"USED", "REFUNDED", "EXCHANGED"}
+)
+
+// Check the passengerType, concessionCategory and ticketStatus of a
+// transit object. Unset fields are allowed.
+func validateTicketEnums(transitObject *walletobjects.TransitObject) error {
+	fields := []struct {
+		name, value string
+		values      []string
+	}{
+		{"passengerType", transitObject.PassengerType, passengerTypes},
+		{"concessionCategory", transitObject.ConcessionCategory, concessionCategories},
+		{"ticketStatus", transitObject.TicketStatus, ticketStatuses},
+	}
+	for _, field := range fields {
+		if field.value == "" {
+			continue
+		}
+		known := false
+		for _, value := range field.values {
+			if field.value == value {
+				known = true
+			}
+		}
+		if !known {
+			return fmt.Errorf("unknown %s %q, must be one of %s", field.name, field.value, strings.Join(field.values, ", "))
+		}
+	}
+	return nil
+}
+
+// Check that each ticket leg has its stations, and that the legs are in
+// chronological order: each leg arrives after it departs, and departs no
+// earlier than the previous leg arrives.
+//
+// Times without an offset are local to their station, so legs crossing time
+// zones should be given with offsets to be compared correctly.
+func validateTicketLegs(legs []*walletobjects.TicketLeg) error {
+	var previousArrival time.Time
+	for i, leg := range legs {
+		if leg.OriginStationCode == "" || leg.DestinationStationCode == "" {
+			return fmt.Errorf("ticket leg %d is missing its origin or destination station", i)
+		}
+		departure, err := parseLegTime(leg.DepartureDateTime)
+		if err != nil {
+			return fmt.Errorf("ticket leg %d departure: %w", i, err)
+		}
+		arrival, err := parseLegTime(leg.ArrivalDateTime)
+		if err != nil {
+			return fmt.Errorf("ticket leg %d arrival: %w", i, err)
+		}
+		if !arrival.IsZero() && !departure.IsZero() && arrival.Before(departure) {
+			return fmt.Errorf("ticket leg %d arrives before it departs", i)
+		}
+		if !departure.IsZero() && !previousArrival.IsZero() && departure.Before(previousArrival) {
+			return fmt.Errorf("ticket leg %d departs before leg %d arrives", i, i-1)
+		}
+		if !arrival.IsZero() {
+			previousArrival = arrival
+		}
+	}
+	return nil
+}
+
+// Parse a ticket leg date/time, with or without an offset. An empty value
+// is the zero time.
+func parseLegTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02T15:04"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date/time %q", value)
+}
+
+// [END multiLeg]
+
 // [START expireObject]
 // Expire an object.
 //
@@ -173,6 +354,34 @@ func (d *demoTransit) expireObject(issuerId, objectSuffix string) {
 
 // [END expireObject]
 
+// [START updateTicketStatus]
+// Update the status of a ticket, e.g. to USED once the passenger has
+// passed the gate, or REFUNDED.
+//
+// The ticket status is shown on the pass but doesn't change how it's
+// displayed otherwise; expire the object as well to move it out of the
+// user's active passes.
+func (d *demoTransit) updateTicketStatus(issuerId, objectSuffix, ticketStatus string) {
+	// An empty status would be left out of the patch, changing nothing
+	if ticketStatus == "" {
+		log.Fatalf("Ticket status is empty")
+	}
+	patch := &walletobjects.TransitObject{
+		TicketStatus: ticketStatus,
+	}
+	if err := validateTicketEnums(patch); err != nil {
+		log.Fatalf("Invalid ticket status: %v", err)
+	}
+	res, err := d.service.Transitobject.Patch(fmt.Sprintf("%s.%s", issuerId, objectSuffix), patch).Do()
+	if err != nil {
+		log.Fatalf("Unable to patch object: %v", err)
+	} else {
+		fmt.Printf("Object ticket status update id:\n%s\n", res.Id)
+	}
+}
+
+// [END updateTicketStatus]
+
 // [START jwtNew]
 // Generate a signed JWT that creates a new pass class and object.
 //
@@ -230,38 +439,38 @@ func (d *demoTransit) createJwtExistingObjects(issuerId string, classSuffix stri
 	json.Unmarshal([]byte(fmt.Sprintf(`
 	{
 		"eventTicketObjects": [{
-			"id": "%s.EVENT_OBJECT_SUFFIX",
-			"classId": "%s.EVENT_CLASS_SUFFIX"
+			"id": "%[1]s.EVENT_OBJECT_SUFFIX",
+			"classId": "%[1]s.EVENT_CLASS_SUFFIX"
 		}],
 
 		"flightObjects": [{
-			"id": "%s.FLIGHT_OBJECT_SUFFIX",
-			"classId": "%s.FLIGHT_CLASS_SUFFIX"
+			"id": "%[1]s.FLIGHT_OBJECT_SUFFIX",
+			"classId": "%[1]s.FLIGHT_CLASS_SUFFIX"
 		}],
 
 		"genericObjects": [{
-			"id": "%s.GENERIC_OBJECT_SUFFIX",
-			"classId": "%s.GENERIC_CLASS_SUFFIX"
+			"id": "%[1]s.GENERIC_OBJECT_SUFFIX",
+			"classId": "%[1]s.GENERIC_CLASS_SUFFIX"
 		}],
 
 		"giftCardObjects": [{
-			"id": "%s.GIFT_CARD_OBJECT_SUFFIX",
-			"classId": "%s.GIFT_CARD_CLASS_SUFFIX"
+			"id": "%[1]s.GIFT_CARD_OBJECT_SUFFIX",
+			"classId": "%[1]s.GIFT_CARD_CLASS_SUFFIX"
 		}],
 
 		"loyaltyObjects": [{
-			"id": "%s.LOYALTY_OBJECT_SUFFIX",
-			"classId": "%s.LOYALTY_CLASS_SUFFIX"
+			"id": "%[1]s.LOYALTY_OBJECT_SUFFIX",
+			"classId": "%[1]s.LOYALTY_CLASS_SUFFIX"
 		}],
 
 		"offerObjects": [{
-			"id": "%s.OFFER_OBJECT_SUFFIX",
-			"classId": "%s.OFFER_CLASS_SUFFIX"
+			"id": "%[1]s.OFFER_OBJECT_SUFFIX",
+			"classId": "%[1]s.OFFER_CLASS_SUFFIX"
 		}],
 
 		"transitObjects": [{
-			"id": "%s.TRANSIT_OBJECT_SUFFIX",
-			"classId": "%s.TRANSIT_CLASS_SUFFIX"
+			"id": "%[1]s.TRANSIT_OBJECT_SUFFIX",
+			"classId": "%[1]s.TRANSIT_CLASS_SUFFIX"
 		}]
 	}
 	`, issuerId)), &payload)
@@ -335,6 +544,9 @@ func main() {
 	d.auth()
 	d.createClass(issuerId, classSuffix)
 	d.createObject(issuerId, classSuffix, objectSuffix)
+	connectingObjectSuffix := fmt.Sprintf("%s-%s", strings.ReplaceAll(uuid.New().String(), "-", "_"), classSuffix)
+	d.createConnectingObject(issuerId, classSuffix, connectingObjectSuffix)
+	d.updateTicketStatus(issuerId, objectSuffix, "USED")
 	d.expireObject(issuerId, objectSuffix)
 	d.createJwtNewObjects(issuerId, classSuffix, objectSuffix)
 	d.createJwtExistingObjects(issuerId, classSuffix, objectSuffix)
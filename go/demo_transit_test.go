@@ -0,0 +1,89 @@
+//go:build transit
+
+/*
+ * Copyright 2023 Google Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"google.golang.org/api/walletobjects/v1"
+	"testing"
+)
+
+func TestValidateTicketLegs(t *testing.T) {
+	tests := []struct {
+		name    string
+		legs    []*walletobjects.TicketLeg
+		wantErr bool
+	}{
+		{"in order", []*walletobjects.TicketLeg{
+			{OriginStationCode: "LA", DestinationStationCode: "SJ", DepartureDateTime: "2023-06-12T08:00:00", ArrivalDateTime: "2023-06-12T14:30:00"},
+			{OriginStationCode: "SJ", DestinationStationCode: "SFO", DepartureDateTime: "2023-06-12T15:10:00", ArrivalDateTime: "2023-06-12T16:20:00"},
+		}, false},
+		{"without times", []*walletobjects.TicketLeg{
+			{OriginStationCode: "LA", DestinationStationCode: "SJ"},
+			{OriginStationCode: "SJ", DestinationStationCode: "SFO"},
+		}, false},
+		{"with offsets", []*walletobjects.TicketLeg{
+			{OriginStationCode: "LA", DestinationStationCode: "DEN", DepartureDateTime: "2023-06-12T08:00:00-07:00", ArrivalDateTime: "2023-06-12T11:30:00-06:00"},
+			{OriginStationCode: "DEN", DestinationStationCode: "CHI", DepartureDateTime: "2023-06-12T10:45:00-07:00", ArrivalDateTime: "2023-06-12T15:00:00-05:00"},
+		}, false},
+		{"out of order", []*walletobjects.TicketLeg{
+			{OriginStationCode: "SJ", DestinationStationCode: "SFO", DepartureDateTime: "2023-06-12T15:10:00", ArrivalDateTime: "2023-06-12T16:20:00"},
+			{OriginStationCode: "LA", DestinationStationCode: "SJ", DepartureDateTime: "2023-06-12T08:00:00", ArrivalDateTime: "2023-06-12T14:30:00"},
+		}, true},
+		{"arrives before it departs", []*walletobjects.TicketLeg{
+			{OriginStationCode: "LA", DestinationStationCode: "SJ", DepartureDateTime: "2023-06-12T14:30:00", ArrivalDateTime: "2023-06-12T08:00:00"},
+		}, true},
+		{"missing station", []*walletobjects.TicketLeg{
+			{OriginStationCode: "LA"},
+		}, true},
+		{"invalid time", []*walletobjects.TicketLeg{
+			{OriginStationCode: "LA", DestinationStationCode: "SJ", DepartureDateTime: "12 June 2023"},
+		}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := validateTicketLegs(test.legs)
+			if (err != nil) != test.wantErr {
+				t.Errorf("validateTicketLegs() = %v, want error: %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateTicketEnums(t *testing.T) {
+	tests := []struct {
+		name          string
+		transitObject *walletobjects.TransitObject
+		wantErr       bool
+	}{
+		{"unset", &walletobjects.TransitObject{}, false},
+		{"known", &walletobjects.TransitObject{PassengerType: "SINGLE_PASSENGER", ConcessionCategory: "ADULT", TicketStatus: "USED"}, false},
+		{"unknown ticket status", &walletobjects.TransitObject{TicketStatus: "CANCELLED"}, true},
+		{"lowercase ticket status", &walletobjects.TransitObject{TicketStatus: "used"}, true},
+		{"unknown passenger type", &walletobjects.TransitObject{PassengerType: "FAMILY"}, true},
+		{"unknown concession category", &walletobjects.TransitObject{ConcessionCategory: "STUDENT"}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := validateTicketEnums(test.transitObject)
+			if (err != nil) != test.wantErr {
+				t.Errorf("validateTicketEnums() = %v, want error: %v", err, test.wantErr)
+			}
+		})
+	}
+}